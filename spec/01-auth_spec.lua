@@ -1,6 +1,32 @@
 local cjson = require("cjson.safe").new()
+local http = require("resty.luasocket.http")
 local fmt = string.format
 
+local FAKEAZURE = "http://fakeazure:8081"
+
+-- sends a request straight to fakeazure, for what the Azure client does not expose
+local function fakeazure_request(method, path, opts)
+  opts = opts or {}
+
+  local res, err = http.new():request_uri(FAKEAZURE .. path, {
+    method = method,
+    headers = opts.headers,
+    body = opts.body,
+    keepalive = false,
+  })
+  assert.is_nil(err)
+
+  return res, cjson.decode(res.body)
+end
+
+local function token_request(tenant_id, body, content_type)
+  return fakeazure_request("POST", fmt("/%s/oauth2/v2.0/token", tenant_id), {
+    headers = { ["Content-Type"] = content_type or "application/x-www-form-urlencoded" },
+    body = body,
+  })
+end
+
+
 function getTableSize(t)
   local count = 0
   for _, __ in pairs(t) do
@@ -202,3 +228,200 @@ describe("Azure Authentication interfaces ", function()
   end)
 
 end)
+
+
+describe("Managed Identity endpoint of fakeazure", function()
+  it("IMDS answers with string-typed expiry fields", function()
+    local res, body = fakeazure_request("GET", "/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https://vault.azure.net", {
+      headers = { ["Metadata"] = "true" },
+    })
+
+    assert.same(200, res.status)
+    assert.same("string", type(body.expires_in))
+    assert.same("string", type(body.expires_on))
+    assert.same("string", type(body.not_before))
+    assert.same("https://vault.azure.net", body.resource)
+    assert.same("Bearer", body.token_type)
+    assert.not_nil(body.access_token)
+  end)
+
+  it("IMDS refuses requests without the Metadata header", function()
+    local res, body = fakeazure_request("GET", "/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https://vault.azure.net")
+
+    assert.same(400, res.status)
+    assert.same("invalid_request", body.error)
+  end)
+
+  it("App Service errors come in its own envelope", function()
+    local res, body = fakeazure_request("GET", "/MSI/token/?api-version=2017-09-01&resource=https://vault.azure.net", {
+      headers = { ["X-IDENTITY-HEADER"] = "fake_identity_header" },
+    })
+
+    assert.same(400, res.status)
+    assert.same(400, body.statusCode)
+    assert.same("Only api-version 2019-08-01 is supported", body.message)
+    assert.not_nil(body.correlationId)
+  end)
+
+  it("ManagedIdentityCredentials turns the string expires_in into an expiry time", function()
+    -- get an azure client, override all environment defaults
+    local azure_client = require("resty.azure"):new({
+      auth_base_url = "http://fakeazure:8081",
+      instance_metadata_host = "fakeazure:8081",
+    })
+
+    local _, err = azure_client:authenticate()
+    assert.is_nil(err)
+
+    ngx.update_time()
+    local ok, token, expiry, err = azure_client.credentials:get()
+    assert.is_truthy(ok)
+    assert.is_nil(err)
+    assert.not_nil(token)
+    assert.same("number", type(expiry))
+    assert.is_true(expiry > ngx.now())
+  end)
+end)
+
+
+describe("AAD device code endpoint of fakeazure", function()
+  it("an approved device code is only redeemed once, by the client that asked for it", function()
+    local res, authorization = fakeazure_request("POST", "/fake_tenant/oauth2/v2.0/devicecode", {
+      headers = { ["Content-Type"] = "application/x-www-form-urlencoded" },
+      body = "client_id=fake_client&scope=openid",
+    })
+    assert.same(200, res.status)
+
+    local res = fakeazure_request("POST", fmt("/admin/devicecodes/%s/approve", authorization.user_code))
+    assert.same(204, res.status)
+
+    local poll = fmt("grant_type=urn:ietf:params:oauth:grant-type:device_code&device_code=%s&client_id=", authorization.device_code)
+
+    local res, body = token_request("fake_tenant", poll .. "other_client")
+    assert.same(400, res.status)
+    assert.same("invalid_grant", body.error)
+
+    local res, body = token_request("fake_tenant", poll .. "fake_client")
+    assert.same(200, res.status)
+    assert.not_nil(body.access_token)
+
+    local res, body = token_request("fake_tenant", poll .. "fake_client")
+    assert.same(400, res.status)
+    assert.same("invalid_grant", body.error)
+  end)
+end)
+
+
+describe("Key Vault Bearer challenge of fakeazure", function()
+  it("a request without a token gets the challenge naming the tenant and resource", function()
+    local res, body = fakeazure_request("GET", "/keyvault/jack-vault/secrets/demo?api-version=7.1")
+
+    assert.same(401, res.status)
+    assert.same('Bearer authorization="http://fakeazure:8081/fake_tenant", resource="https://vault.azure.net"', res.headers["WWW-Authenticate"])
+    assert.same("Unauthorized", body.error.code)
+    assert.matches("AKV10000", body.error.message)
+  end)
+
+  it("a token from another tenant gets AKV10032", function()
+    -- get an azure client, override all environment defaults
+    local azure_client = require("resty.azure"):new({
+      auth_base_url = "http://fakeazure:8081",
+      client_id = "fake_client",
+      client_secret = "fake_secret",
+      tenant_id = "other_tenant",
+      instance_metadata_host = "fakeazure:8081/fail",
+    })
+    local secret_client = azure_client:secrets("http://fakeazure:8081/keyvault/jack-vault")
+    local response, err = secret_client:get("demo")
+
+    assert.is_nil(err)
+    assert.same("Unauthorized", response.error.code)
+    assert.matches("AKV10032: Invalid issuer", response.error.message)
+  end)
+end)
+
+
+describe("AAD token request validation of fakeazure", function()
+  it("client credentials without a secret or assertion get AADSTS7000216", function()
+    local res, body = token_request("fake_tenant", "grant_type=client_credentials&client_id=fake_client&scope=https://vault.azure.net/.default")
+
+    assert.same(401, res.status)
+    assert.same("invalid_client", body.error)
+    assert.same(7000216, body.error_codes[1])
+    assert.matches("^AADSTS7000216:", body.error_description)
+  end)
+
+  it("client credentials with both a secret and an assertion get AADSTS7000216", function()
+    local res, body = token_request("fake_tenant", "grant_type=client_credentials&client_id=fake_client&client_secret=fake_secret" ..
+      "&client_assertion=fake_assertion&client_assertion_type=urn:ietf:params:oauth:client-assertion-type:jwt-bearer" ..
+      "&scope=https://vault.azure.net/.default")
+
+    assert.same(400, res.status)
+    assert.same("invalid_request", body.error)
+    assert.same(7000216, body.error_codes[1])
+  end)
+
+  it("client credentials without a /.default scope get AADSTS70011", function()
+    local res, body = token_request("fake_tenant", "grant_type=client_credentials&client_id=fake_client&client_secret=fake_secret&scope=https://vault.azure.net")
+
+    assert.same(400, res.status)
+    assert.same("invalid_scope", body.error)
+    assert.same(70011, body.error_codes[1])
+  end)
+
+  it("a token request that is not form-encoded gets AADSTS900144", function()
+    local res, body = token_request("fake_tenant", cjson.encode({ grant_type = "client_credentials", client_id = "fake_client" }), "application/json")
+
+    assert.same(400, res.status)
+    assert.same("invalid_request", body.error)
+    assert.same(900144, body.error_codes[1])
+  end)
+
+  it("an unknown grant type gets AADSTS70003", function()
+    local res, body = token_request("fake_tenant", "grant_type=password&client_id=fake_client&client_secret=fake_secret")
+
+    assert.same(400, res.status)
+    assert.same("unsupported_grant_type", body.error)
+    assert.same(70003, body.error_codes[1])
+  end)
+
+  it("ClientCredentials gets the AADSTS error of a bad client secret", function()
+    local _, err = require("resty.azure.credentials.ClientCredentials"):new(require("resty.azure.config").global, {
+      auth_base_url = "http://fakeazure:8081",
+      client_id = "fake_client",
+      client_secret = "fake_secret",
+      tenant_id = "fake_tenant",
+      extra_auth_parameters = "?withcode=401",
+    })
+
+    local body = cjson.decode(err)
+    assert.same("invalid_client", body.error)
+    assert.same(7000215, body.error_codes[1])
+  end)
+end)
+
+
+describe("AAD discovery endpoints of fakeazure", function()
+  it("the metadata under /authority/ points at endpoints that are served", function()
+    local res, configuration = fakeazure_request("GET", "/authority/fake_tenant/v2.0/.well-known/openid-configuration")
+    assert.same(200, res.status)
+    assert.same("http://fakeazure:8081/authority/fake_tenant/oauth2/v2.0/token", configuration.token_endpoint)
+
+    local res = fakeazure_request("GET", configuration.jwks_uri:sub(#FAKEAZURE + 1))
+    assert.same(200, res.status)
+
+    local res = fakeazure_request("POST", configuration.device_authorization_endpoint:sub(#FAKEAZURE + 1), {
+      headers = { ["Content-Type"] = "application/x-www-form-urlencoded" },
+      body = "client_id=fake_client&scope=openid",
+    })
+    assert.same(200, res.status)
+  end)
+
+  it("instance discovery under /authority/ finds the tenant of the authority", function()
+    local authority = "http://fakeazure:8081/authority/fake_tenant/oauth2/v2.0/authorize"
+    local res, discovery = fakeazure_request("GET", "/authority/common/discovery/instance?api-version=1.1&authorization_endpoint=" .. ngx.escape_uri(authority))
+
+    assert.same(200, res.status)
+    assert.same("http://fakeazure:8081/authority/fake_tenant/v2.0/.well-known/openid-configuration", discovery.tenant_discovery_endpoint)
+  end)
+end)
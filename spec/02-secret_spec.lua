@@ -1,5 +1,33 @@
+local cjson = require("cjson.safe").new()
+local http = require("resty.luasocket.http")
 local fmt = string.format
 
+-- calls the admin API of fakeazure, which sets up faults and limits for the test at hand
+local function fakeazure_admin(method, path, body)
+  local res, err = http.new():request_uri("http://fakeazure:8081/admin" .. path, {
+    method = method,
+    headers = { ["Content-Type"] = "application/json" },
+    body = body and cjson.encode(body),
+    keepalive = false,
+  })
+  assert.is_nil(err)
+
+  return res, cjson.decode(res.body)
+end
+
+local function new_secret_client(vault_name)
+  -- get an azure client, override all environment defaults
+  local azure_client = require("resty.azure"):new({
+    auth_base_url = "http://fakeazure:8081",
+    client_id = "fake_client",
+    client_secret = "fake_secret",
+    tenant_id = "fake_tenant",
+    instance_metadata_host = "fakeazure:8081/fail",
+  })
+
+  return azure_client:secrets("http://fakeazure:8081/keyvault/" .. (vault_name or "jack-vault")), azure_client
+end
+
 describe("Test all Key Vault Secrets interfaces #", function()
   it("valid credentials and existing secret", function()
     -- get an azure client, override all environment defaults
@@ -148,3 +176,191 @@ describe("Test all Key Vault Secrets interfaces #", function()
     assert.same('failed to make azure request: could not authenticate. no authentication mechanism worked for azure', err)
   end)
 end)
+
+
+describe("Key Vault access policies of fakeazure #", function()
+  it("a vault with access policies refuses callers it has no policy for", function()
+    local res = fakeazure_admin("PATCH", "/vaults/policy-vault", {
+      enableRbacAuthorization = false,
+      accessPolicies = {
+        { tenantId = "fake_tenant", objectId = "someone-else", permissions = { secrets = { "get" } } },
+      },
+    })
+    assert.same(200, res.status)
+
+    local secret_client = new_secret_client("policy-vault")
+    local response, err = secret_client:get("demo")
+
+    assert.is_nil(err)
+    assert.same("Forbidden", response.error.code)
+    assert.same("AccessDenied", response.error.innererror.code)
+  end)
+
+  it("a patched access policy list replaces the old one", function()
+    local res = fakeazure_admin("PATCH", "/vaults/replaced-policy-vault", {
+      enableRbacAuthorization = false,
+      accessPolicies = {
+        { tenantId = "fake_tenant", objectId = "5e6f7a8b-0000-4000-8000-000000000001", permissions = { secrets = { "get" } } },
+      },
+    })
+    assert.same(200, res.status)
+
+    local res, vault = fakeazure_admin("PATCH", "/vaults/replaced-policy-vault", {
+      accessPolicies = {
+        { tenantId = "fake_tenant", objectId = "someone-else", permissions = { certificates = { "get" } } },
+      },
+    })
+    assert.same(200, res.status)
+    assert.same(1, #vault.accessPolicies)
+
+    local secret_client = new_secret_client("replaced-policy-vault")
+    local response, err = secret_client:get("demo")
+
+    assert.is_nil(err)
+    assert.same("Forbidden", response.error.code)
+    assert.same("AccessDenied", response.error.innererror.code)
+  end)
+end)
+
+
+describe("Key Vault Secrets with fakeazure fault rules #", function()
+  it("a fault rule fails the first call only", function()
+    local res = fakeazure_admin("PUT", "/faults/first-call-fails", {
+      method = "GET",
+      path = "/keyvault/jack-vault/secrets/demo",
+      status = 500,
+      body = { error = { code = "InternalServerError", message = "injected by a fault rule" } },
+      times = 1,
+    })
+    assert.same(200, res.status)
+    finally(function() fakeazure_admin("DELETE", "/faults/first-call-fails") end)
+
+    local secret_client = new_secret_client()
+
+    local _, err = secret_client:get("demo")
+    assert.same("internal server error", err)
+
+    local secret_object, err = secret_client:get("demo")
+    assert.is_nil(err)
+    assert.same("This is the fake secret value", secret_object.value)
+
+    local _, rules = fakeazure_admin("GET", "/faults")
+    assert.same(1, rules.value[1].fired)
+  end)
+
+  it("a fault rule on the token endpoint fails authentication", function()
+    local res = fakeazure_admin("PUT", "/faults/token-unavailable", {
+      method = "POST",
+      path = "/fake_tenant/oauth2/v2.0/token",
+      status = 503,
+      body = { error = "temporarily_unavailable" },
+      times = 1,
+    })
+    assert.same(200, res.status)
+    finally(function() fakeazure_admin("DELETE", "/faults/token-unavailable") end)
+
+    local secret_client = new_secret_client()
+
+    local _, err = secret_client:get("demo")
+    assert.same("failed to make azure request: could not authenticate. no authentication mechanism worked for azure", err)
+
+    local secret_object, err = secret_client:get("demo")
+    assert.is_nil(err)
+    assert.same("This is the fake secret value", secret_object.value)
+  end)
+end)
+
+
+describe("Key Vault Secrets with fakeazure throttling #", function()
+
+  it("reads over the vault's limit are throttled", function()
+    -- a frozen clock keeps both reads in the same throttling window
+    fakeazure_admin("POST", "/clock/freeze")
+    local res = fakeazure_admin("PUT", "/throttling", { key_vault = { secrets = 1 } })
+    assert.same(200, res.status)
+    finally(function()
+      fakeazure_admin("PUT", "/throttling", {})
+      fakeazure_admin("POST", "/clock/reset")
+    end)
+
+    local secret_client = new_secret_client()
+
+    local secret_object, err = secret_client:get("demo")
+    assert.is_nil(err)
+    assert.same("This is the fake secret value", secret_object.value)
+
+    local response, err = secret_client:get("demo")
+    assert.is_nil(err)
+    assert.same("Throttled", response.error.code)
+    assert.same("VaultRequestTypeLimitReached", response.error.innererror.code)
+  end)
+
+  it("token requests over the limit get AADSTS50196", function()
+    fakeazure_admin("POST", "/clock/freeze")
+    local res = fakeazure_admin("PUT", "/throttling", { token_requests = 1 })
+    assert.same(200, res.status)
+    finally(function()
+      fakeazure_admin("PUT", "/throttling", {})
+      fakeazure_admin("POST", "/clock/reset")
+    end)
+
+    local ClientCredentials = require("resty.azure.credentials.ClientCredentials")
+    local opts = {
+      auth_base_url = "http://fakeazure:8081",
+      client_id = "fake_client",
+      client_secret = "fake_secret",
+      tenant_id = "fake_tenant",
+    }
+
+    local _, err = ClientCredentials:new(require("resty.azure.config").global, opts)
+    assert.is_nil(err)
+
+    local _, err = ClientCredentials:new(require("resty.azure.config").global, opts)
+    local body = cjson.decode(err)
+    assert.same("temporarily_unavailable", body.error)
+    assert.same(50196, body.error_codes[1])
+  end)
+end)
+
+
+describe("Key Vault Secrets with fakeazure fault switches #", function()
+  it("switches set for the client apply without touching the URL", function()
+    local res = fakeazure_admin("PUT", "/clientFaults/fake_client", { fault = "withcode=401" })
+    assert.same(200, res.status)
+    finally(function() fakeazure_admin("DELETE", "/clientFaults/fake_client") end)
+
+    local secret_client = new_secret_client()
+    local secret_object, err = secret_client:get("demo")
+
+    assert.is_nil(secret_object)
+    assert.same("failed to make azure request: could not authenticate. no authentication mechanism worked for azure", err)
+  end)
+
+  it("the x-fakeazure-fault header picks the Key Vault error", function()
+    local _, azure_client = new_secret_client()
+    local _, err = azure_client:authenticate()
+    assert.is_nil(err)
+    local _, token = azure_client.credentials:get()
+
+    local res, err = http.new():request_uri("http://fakeazure:8081/keyvault/jack-vault/secrets/demo?api-version=7.1", {
+      headers = {
+        ["Authorization"] = "Bearer " .. token,
+        ["x-fakeazure-fault"] = "withcode=429",
+      },
+      keepalive = false,
+    })
+    assert.is_nil(err)
+
+    assert.same(429, res.status)
+    assert.not_nil(res.headers["Retry-After"])
+    assert.same("Throttled", cjson.decode(res.body).error.code)
+  end)
+
+  it("secret not found gets the Key Vault error of the collection", function()
+    local secret_client = new_secret_client()
+    local response, err = secret_client:get("demo", nil, { extra_query_args = "&withcode=404" })
+
+    assert.is_nil(err)
+    assert.same("SecretNotFound", response.error.code)
+  end)
+end)
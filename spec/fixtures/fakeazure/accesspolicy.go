@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// AccessPolicy is one entry of a vault's legacy access policy list
+type AccessPolicy struct {
+	TenantID    string                  `json:"tenantId"`
+	ObjectID    string                  `json:"objectId"`
+	Permissions AccessPolicyPermissions `json:"permissions"`
+}
+
+type AccessPolicyPermissions struct {
+	Keys         []string `json:"keys"`
+	Secrets      []string `json:"secrets"`
+	Certificates []string `json:"certificates"`
+}
+
+func (p *AccessPolicy) clone() *AccessPolicy {
+	if p == nil {
+		return nil
+	}
+
+	copied := *p
+	copied.Permissions.Keys = copyStrings(p.Permissions.Keys)
+	copied.Permissions.Secrets = copyStrings(p.Permissions.Secrets)
+	copied.Permissions.Certificates = copyStrings(p.Permissions.Certificates)
+
+	return &copied
+}
+
+// copyStrings keeps an empty list empty rather than nil, so that it is still listed as []
+func copyStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+
+	return append(make([]string, 0, len(values)), values...)
+}
+
+// accessPolicyPermissions maps the data actions checked by the handlers onto access policy permissions
+var accessPolicyPermissions = map[string]string{
+	SecretGetAction:       "get",
+	SecretDeleteAction:    "delete",
+	KeyReadAction:         "get",
+	CertificateReadAction: "get",
+}
+
+func (p *AccessPolicy) permissionsFor(collection string) []string {
+	switch collection {
+	case "keys":
+		return p.Permissions.Keys
+	case "secrets":
+		return p.Permissions.Secrets
+	case "certificates":
+		return p.Permissions.Certificates
+	}
+
+	return nil
+}
+
+// CheckAccessPolicy says whether a policy for the caller, in the caller's tenant, grants the permission
+func CheckAccessPolicy(vault *Vault, tenantID string, objectID string, collection string, permission string) bool {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	for _, policy := range vault.AccessPolicies {
+		if policy.ObjectID != objectID || (policy.TenantID != "" && policy.TenantID != tenantID) {
+			continue
+		}
+
+		for _, granted := range policy.permissionsFor(collection) {
+			if strings.EqualFold(granted, permission) || strings.EqualFold(granted, "all") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func authorizeAccessPolicy(w http.ResponseWriter, claims Claims, vault *Vault, collection string, action string) bool {
+	permission := accessPolicyPermissions[action]
+	if CheckAccessPolicy(vault, claims.String("tid"), claims.String("oid"), collection, permission) {
+		return true
+	}
+
+	KeyVaultForbiddenByPolicy.Write(w,
+		claims.String("appid"), claims.String("oid"), claims.String("iss"), collection, permission, vault.Name, vault.Location)
+
+	return false
+}
+
+func AdminVaultGet(w http.ResponseWriter, r *http.Request) {
+	vault := FindVault(mux.Vars(r)["vaultName"])
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(vault)
+}
+
+// AdminVaultPatch merges the body into the vault, e.g. to flip enableRbacAuthorization or replace accessPolicies
+func AdminVaultPatch(w http.ResponseWriter, r *http.Request) {
+	// the body is merged into a copy, which replaces the vault once it is complete
+	vault := FindVault(mux.Vars(r)["vaultName"])
+	name := vault.Name
+
+	var fields map[string]json.RawMessage
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &fields)
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "could not parse vault: "+err.Error())
+		return
+	}
+
+	// decoding into the old list would merge the policies entry by entry, so a given list replaces it
+	for field := range fields {
+		if strings.EqualFold(field, "accessPolicies") {
+			vault.AccessPolicies = nil
+		}
+	}
+
+	if err := json.Unmarshal(body, vault); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "could not parse vault: "+err.Error())
+		return
+	}
+	vault.Name = name
+	ReplaceVault(vault)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(vault)
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// AuthorizationCode is what the authorize endpoint remembers until the code is redeemed
+type AuthorizationCode struct {
+	ClientID            string
+	TenantID            string
+	RedirectURI         string
+	Scopes              []string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	User                *TestUser
+	ExpiresAt           int64
+	Redeemed            bool
+}
+
+// RefreshGrant backs one refresh token
+type RefreshGrant struct {
+	ClientID  string
+	TenantID  string
+	Scopes    []string
+	User      *TestUser
+	ExpiresAt int64
+	Used      bool
+	Revoked   bool
+}
+
+type DelegatedTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int32  `json:"expires_in"`
+	ExtExpiresIn int32  `json:"ext_expires_in"`
+	IDToken      string `json:"id_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+	TokenType    string `json:"token_type"`
+}
+
+var authorizationCodes = map[string]*AuthorizationCode{}
+var refreshGrants = map[string]*RefreshGrant{}
+var delegatedLock sync.Mutex
+
+// codes live for ten minutes and refresh tokens for 90 days, like the real authority
+const authorizationCodeLifetime = 600
+const refreshTokenLifetime = 90 * 24 * 3600
+
+var oidcScopes = map[string]bool{
+	"openid":         true,
+	"profile":        true,
+	"email":          true,
+	"offline_access": true,
+}
+
+// OAuthAuthorizeGet signs in a test user and consents on their behalf, then redirects straight back with a code
+func OAuthAuthorizeGet(w http.ResponseWriter, r *http.Request) {
+	tenantID := mux.Vars(r)["tenantId"]
+	query := r.URL.Query()
+
+	clientID := query.Get("client_id")
+	redirectURI := query.Get("redirect_uri")
+	if clientID == "" || redirectURI == "" {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("<html><body>AADSTS900144: The request body must contain the following parameter: 'client_id' and 'redirect_uri'.</body></html>"))
+
+		return
+	}
+
+	redirect, err := url.Parse(redirectURI)
+	if err != nil || !redirect.IsAbs() {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("<html><body>AADSTS50011: The redirect URI specified in the request is not a valid absolute URI.</body></html>"))
+
+		return
+	}
+
+	responseMode := query.Get("response_mode")
+	state := query.Get("state")
+
+	if query.Get("response_type") != "code" {
+		redirectWithParams(w, r, redirect, responseMode, url.Values{
+			"error":             {"unsupported_response_type"},
+			"error_description": {"AADSTS700054: response_type 'code' is the only response_type supported by fakeazure."},
+			"state":             {state},
+		})
+
+		return
+	}
+
+	codeChallengeMethod := query.Get("code_challenge_method")
+	if query.Get("code_challenge") != "" && codeChallengeMethod == "" {
+		codeChallengeMethod = "plain"
+	}
+	if codeChallengeMethod != "" && codeChallengeMethod != "S256" && codeChallengeMethod != "plain" {
+		redirectWithParams(w, r, redirect, responseMode, url.Values{
+			"error":             {"invalid_request"},
+			"error_description": {"AADSTS501491: Invalid size of Code_Challenge parameter or unsupported Code_Challenge_Method."},
+			"state":             {state},
+		})
+
+		return
+	}
+
+	user := signInUser(query.Get("login_hint"))
+	if user == nil {
+		redirectWithParams(w, r, redirect, responseMode, url.Values{
+			"error":             {"invalid_request"},
+			"error_description": {"AADSTS50034: The user account does not exist in this directory."},
+			"state":             {state},
+		})
+
+		return
+	}
+
+	code := RandStringRunes(64)
+
+	delegatedLock.Lock()
+	authorizationCodes[code] = &AuthorizationCode{
+		ClientID:            clientID,
+		TenantID:            tenantID,
+		RedirectURI:         redirectURI,
+		Scopes:              strings.Fields(query.Get("scope")),
+		Nonce:               query.Get("nonce"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: codeChallengeMethod,
+		User:                user,
+		ExpiresAt:           Now().Unix() + authorizationCodeLifetime,
+	}
+	delegatedLock.Unlock()
+
+	redirectWithParams(w, r, redirect, responseMode, url.Values{
+		"code":          {code},
+		"state":         {state},
+		"session_state": {ObjectIDFor(user.ObjectID + code)},
+	})
+}
+
+// signInUser picks the user named by login_hint, or the first configured user
+func signInUser(loginHint string) *TestUser {
+	if loginHint != "" {
+		return FindUser(loginHint)
+	}
+
+	if len(Config.Users) == 0 {
+		return nil
+	}
+
+	return Config.Users[0]
+}
+
+func redirectWithParams(w http.ResponseWriter, r *http.Request, redirect *url.URL, responseMode string, params url.Values) {
+	if params.Get("state") == "" {
+		params.Del("state")
+	}
+
+	switch responseMode {
+	case "form_post":
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `<html><body onload="document.forms[0].submit()"><form method="POST" action="%s">`, html.EscapeString(redirect.String()))
+		for name := range params {
+			fmt.Fprintf(w, `<input type="hidden" name="%s" value="%s"/>`, html.EscapeString(name), html.EscapeString(params.Get(name)))
+		}
+		w.Write([]byte("</form></body></html>"))
+
+		return
+
+	case "fragment":
+		target := *redirect
+		target.Fragment = params.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+
+	default:
+		target := *redirect
+		query := target.Query()
+		for name := range params {
+			query.Set(name, params.Get(name))
+		}
+		target.RawQuery = query.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+	}
+}
+
+func verifyCodeChallenge(code *AuthorizationCode, verifier string) bool {
+	if code.CodeChallenge == "" {
+		return true
+	}
+
+	if code.CodeChallengeMethod == "plain" {
+		return verifier == code.CodeChallenge
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:]) == code.CodeChallenge
+}
+
+func oauthAuthorizationCodeGrant(w http.ResponseWriter, r *http.Request, tenantID string, lifetime int) {
+	codeValue := r.PostForm.Get("code")
+	if codeValue == "" {
+		AADMissingParameter.Write(w, "code")
+		return
+	}
+
+	delegatedLock.Lock()
+	code, ok := authorizationCodes[codeValue]
+	redeemed := ok && code.Redeemed
+	if ok {
+		code.Redeemed = true
+	}
+	delegatedLock.Unlock()
+
+	switch {
+	case !ok:
+		AADMalformedGrant.Write(w)
+		return
+
+	case redeemed:
+		AADCodeRedeemed.Write(w)
+		return
+
+	case Now().Unix() > code.ExpiresAt:
+		AADGrantExpired.Write(w)
+		return
+
+	case code.ClientID != r.PostForm.Get("client_id") || code.TenantID != tenantID:
+		AADCodeWrongClient.Write(w)
+		return
+
+	case code.RedirectURI != r.PostForm.Get("redirect_uri"):
+		AADRedirectURIMismatch.Write(w)
+		return
+
+	case !verifyCodeChallenge(code, r.PostForm.Get("code_verifier")):
+		AADCodeVerifierMismatch.Write(w)
+		return
+	}
+
+	writeDelegatedTokens(w, CloudFor(r), code.ClientID, code.TenantID, code.User, code.Scopes, code.Nonce, lifetime)
+}
+
+func oauthRefreshTokenGrant(w http.ResponseWriter, r *http.Request, tenantID string, lifetime int) {
+	refreshToken := r.PostForm.Get("refresh_token")
+	if refreshToken == "" {
+		AADMissingParameter.Write(w, "refresh_token")
+		return
+	}
+
+	delegatedLock.Lock()
+	stored, ok := refreshGrants[refreshToken]
+	var grant RefreshGrant
+	if ok {
+		grant = *stored
+
+		// only the client and tenant the token was issued to can spend it
+		if grant.ClientID == r.PostForm.Get("client_id") && grant.TenantID == tenantID {
+			stored.Used = true
+		}
+	}
+	delegatedLock.Unlock()
+
+	switch {
+	case !ok:
+		AADMalformedGrant.Write(w)
+		return
+
+	case grant.Revoked:
+		AADGrantRevoked.Write(w)
+		return
+
+	case Now().Unix() > grant.ExpiresAt:
+		AADGrantExpired.Write(w)
+		return
+
+	case grant.ClientID != r.PostForm.Get("client_id") || grant.TenantID != tenantID:
+		AADInvalidGrant.Write(w)
+		return
+
+	case grant.Used:
+		// a rotated token is refused on its own, so a client retrying a refresh keeps its session
+		AADInvalidGrant.Write(w)
+		return
+	}
+
+	scopes := strings.Fields(r.PostForm.Get("scope"))
+	if len(scopes) == 0 {
+		scopes = grant.Scopes
+	}
+	if !hasScope(scopes, "offline_access") {
+		// the old refresh token is spent, so the client always gets a new one back
+		scopes = append(scopes, "offline_access")
+	}
+
+	writeDelegatedTokens(w, CloudFor(r), grant.ClientID, grant.TenantID, grant.User, scopes, "", lifetime)
+}
+
+func writeDelegatedTokens(w http.ResponseWriter, cloud *CloudProfile, clientID string, tenantID string, user *TestUser, scopes []string, nonce string, lifetime int) {
+	now := Now().Unix()
+	accessToken, grantedScope := IssueUserToken(cloud, tenantID, clientID, user, scopes, now, lifetime)
+
+	response := DelegatedTokenResponse{
+		AccessToken:  accessToken,
+		ExpiresIn:    int32(lifetime),
+		ExtExpiresIn: int32(lifetime),
+		Scope:        grantedScope,
+		TokenType:    "Bearer",
+	}
+
+	if hasScope(scopes, "openid") {
+		response.IDToken = MintToken(Claims{
+			"aud":                clientID,
+			"iss":                cloud.Issuer(tenantID, "2.0"),
+			"iat":                now,
+			"nbf":                now,
+			"exp":                now + 3600,
+			"name":               user.Name,
+			"nonce":              nonce,
+			"oid":                user.ObjectID,
+			"preferred_username": user.UPN,
+			"sub":                ObjectIDFor(user.ObjectID + clientID),
+			"tid":                tenantID,
+			"ver":                "2.0",
+		})
+	}
+
+	if hasScope(scopes, "offline_access") {
+		response.RefreshToken = RandStringRunes(96)
+
+		delegatedLock.Lock()
+		refreshGrants[response.RefreshToken] = &RefreshGrant{
+			ClientID:  clientID,
+			TenantID:  tenantID,
+			Scopes:    scopes,
+			User:      user,
+			ExpiresAt: Now().Unix() + refreshTokenLifetime,
+		}
+		delegatedLock.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// IssueUserToken mints a delegated token for the first resource scope, and returns it with the granted scope string
+func IssueUserToken(cloud *CloudProfile, tenantID string, clientID string, user *TestUser, scopes []string, now int64, lifetime int) (string, string) {
+	audience, permissions := "https://graph.microsoft.com", []string{}
+
+	for _, scope := range scopes {
+		if oidcScopes[scope] {
+			continue
+		}
+
+		if strings.HasSuffix(scope, "/.default") {
+			audience = strings.TrimSuffix(scope, "/.default")
+			permissions = append(permissions, "user_impersonation")
+			break
+		}
+
+		if scheme := strings.Index(scope, "://"); scheme >= 0 && strings.LastIndex(scope, "/") > scheme+2 {
+			slash := strings.LastIndex(scope, "/")
+			audience = scope[:slash]
+			permissions = append(permissions, scope[slash+1:])
+			continue
+		}
+
+		permissions = append(permissions, scope)
+	}
+
+	expiresAt := now + int64(lifetime)
+	token := IssueToken(Claims{
+		"aud":   audience,
+		"iss":   cloud.Issuer(tenantID, "1.0"),
+		"iat":   now,
+		"nbf":   now,
+		"exp":   expiresAt,
+		"appid": clientID,
+		"idtyp": "user",
+		"name":  user.Name,
+		"oid":   user.ObjectID,
+		"scp":   strings.Join(permissions, " "),
+		"sub":   ObjectIDFor(user.ObjectID + clientID),
+		"tid":   tenantID,
+		"upn":   user.UPN,
+		"ver":   "1.0",
+		"uti":   RandStringRunes(22),
+	})
+
+	granted := []string{}
+	for _, permission := range permissions {
+		granted = append(granted, audience+"/"+permission)
+	}
+	for _, scope := range scopes {
+		if oidcScopes[scope] {
+			granted = append(granted, scope)
+		}
+	}
+
+	return token, strings.Join(granted, " ")
+}
+
+func hasScope(scopes []string, wanted string) bool {
+	for _, scope := range scopes {
+		if scope == wanted {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SweepDelegatedGrants forgets authorization codes and refresh tokens that expired before the cutoff,
+// and returns how many were removed
+func SweepDelegatedGrants(cutoff int64) int {
+	delegatedLock.Lock()
+	defer delegatedLock.Unlock()
+
+	swept := 0
+	for code, stored := range authorizationCodes {
+		if stored.ExpiresAt < cutoff {
+			delete(authorizationCodes, code)
+			swept++
+		}
+	}
+
+	for token, grant := range refreshGrants {
+		if grant.ExpiresAt < cutoff {
+			delete(refreshGrants, token)
+			swept++
+		}
+	}
+
+	return swept
+}
+
+// AdminRevokeSignInSessions mirrors Graph's revokeSignInSessions: every refresh and access token of the user stops working
+func AdminRevokeSignInSessions(w http.ResponseWriter, r *http.Request) {
+	user := FindUser(mux.Vars(r)["userId"])
+	if user == nil {
+		writeAdminError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	revoked := 0
+
+	delegatedLock.Lock()
+	// a config reload replaces the users, so match on the object ID rather than the pointer
+	for _, grant := range refreshGrants {
+		if grant.User.ObjectID == user.ObjectID && !grant.Revoked {
+			grant.Revoked = true
+			revoked++
+		}
+	}
+	delegatedLock.Unlock()
+
+	// access tokens already handed out stop working too, as with continuous access evaluation
+	revokedAccessTokens := Tokens.RevokePrincipal(user.ObjectID, Now().Unix())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"value":               true,
+		"revoked":             revoked,
+		"revokedAccessTokens": revokedAccessTokens,
+	})
+}
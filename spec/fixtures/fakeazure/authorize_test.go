@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const testRedirectURI = "http://localhost/callback"
+
+// authorizeCode signs the default user in and returns the code handed to the redirect URI
+func authorizeCode(t *testing.T, query url.Values) string {
+	t.Helper()
+
+	query.Set("client_id", "fake_client")
+	query.Set("response_type", "code")
+	query.Set("redirect_uri", testRedirectURI)
+
+	recorder := serve(http.MethodGet, "/fake_tenant/oauth2/v2.0/authorize?"+query.Encode(), "", nil)
+	expectStatus(t, recorder, http.StatusFound)
+
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil || location.Query().Get("code") == "" {
+		t.Fatalf("authorize did not redirect with a code: %q", recorder.Header().Get("Location"))
+	}
+
+	return location.Query().Get("code")
+}
+
+// redeemCode is the token request of a public client redeeming a code
+func redeemCode(code string, verifier string) url.Values {
+	return url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"fake_client"},
+		"redirect_uri":  {testRedirectURI},
+		"code":          {code},
+		"code_verifier": {verifier},
+	}
+}
+
+// signIn runs the authorization code flow without PKCE and returns the token response
+func signIn(t *testing.T) map[string]interface{} {
+	t.Helper()
+
+	code := authorizeCode(t, url.Values{"scope": {"openid offline_access https://vault.azure.net/user_impersonation"}})
+	recorder := postForm("/fake_tenant/oauth2/v2.0/token", redeemCode(code, ""))
+	expectStatus(t, recorder, http.StatusOK)
+
+	return decodeBody(t, recorder)
+}
+
+// refresh spends a refresh token
+func refresh(refreshToken string) *httptest.ResponseRecorder {
+	return postForm("/fake_tenant/oauth2/v2.0/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"fake_client"},
+		"refresh_token": {refreshToken},
+	})
+}
+
+func TestAuthorizationCodeWithPKCE(t *testing.T) {
+	withDefaultConfig(t)
+
+	verifier := "a-code-verifier-long-enough-to-look-like-a-real-one-0123456789"
+	sum := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"scope":                 {"openid offline_access https://vault.azure.net/user_impersonation"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	recorder := postForm("/fake_tenant/oauth2/v2.0/token", redeemCode(authorizeCode(t, query), "not-the-verifier"))
+	expectStatus(t, recorder, http.StatusBadRequest)
+	expectAADError(t, recorder, 501481)
+
+	code := authorizeCode(t, query)
+	recorder = postForm("/fake_tenant/oauth2/v2.0/token", redeemCode(code, verifier))
+	expectStatus(t, recorder, http.StatusOK)
+
+	body := decodeBody(t, recorder)
+	if body["id_token"] == nil || body["refresh_token"] == nil {
+		t.Fatalf("openid and offline_access did not give an id_token and a refresh_token: %v", body)
+	}
+	if claims := accessTokenClaims(t, body); claims.String("oid") != "0b1c2d3e-0000-4000-8000-000000000001" {
+		t.Fatalf("token is not for the signed-in user: %v", claims)
+	}
+
+	// codes are single-use
+	recorder = postForm("/fake_tenant/oauth2/v2.0/token", redeemCode(code, verifier))
+	expectStatus(t, recorder, http.StatusBadRequest)
+	expectAADError(t, recorder, 54005)
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	withDefaultConfig(t)
+
+	first := signIn(t)["refresh_token"].(string)
+
+	recorder := refresh(first)
+	expectStatus(t, recorder, http.StatusOK)
+	second, _ := decodeBody(t, recorder)["refresh_token"].(string)
+	if second == "" || second == first {
+		t.Fatalf("refresh token was not rotated: %q", second)
+	}
+
+	// replaying the rotated token is refused, but does not end the sign-in
+	recorder = refresh(first)
+	expectStatus(t, recorder, http.StatusBadRequest)
+	expectAADError(t, recorder, 70000)
+
+	recorder = refresh(second)
+	expectStatus(t, recorder, http.StatusOK)
+	third, _ := decodeBody(t, recorder)["refresh_token"].(string)
+
+	// another client cannot spend the token, nor use it up for its owner
+	recorder = postForm("/fake_tenant/oauth2/v2.0/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"another_client"},
+		"refresh_token": {third},
+	})
+	expectStatus(t, recorder, http.StatusBadRequest)
+	expectAADError(t, recorder, 70000)
+
+	expectStatus(t, refresh(third), http.StatusOK)
+}
+
+func TestAdminRevokeSignInSessions(t *testing.T) {
+	withDefaultConfig(t)
+
+	body := signIn(t)
+	accessToken := body["access_token"].(string)
+
+	// a reload hands out new user values, which must still match the sessions already granted
+	Config = DefaultConfig()
+
+	recorder := serve(http.MethodPost, "/admin/users/fake_user@fake_tenant.onmicrosoft.com/revokeSignInSessions", "", nil)
+	expectStatus(t, recorder, http.StatusOK)
+
+	// earlier tests may have left sessions of the same user behind
+	if revoked, _ := decodeBody(t, recorder)["revoked"].(float64); revoked < 1 {
+		t.Fatalf("revoked %v refresh tokens, want at least 1", revoked)
+	}
+
+	recorder = refresh(body["refresh_token"].(string))
+	expectStatus(t, recorder, http.StatusBadRequest)
+	expectAADError(t, recorder, 50173)
+
+	if issued, ok := Tokens.Lookup("Bearer " + accessToken); !ok || issued.RevokedAt == 0 {
+		t.Fatalf("access token of the user was not revoked: %+v", issued)
+	}
+}
+
+func TestSweepDelegatedGrants(t *testing.T) {
+	withDefaultConfig(t)
+
+	code := authorizeCode(t, url.Values{"scope": {"offline_access"}})
+	refreshToken := signIn(t)["refresh_token"].(string)
+
+	// nothing has expired yet
+	SweepDelegatedGrants(Now().Unix())
+
+	delegatedLock.Lock()
+	_, codeKept := authorizationCodes[code]
+	_, grantKept := refreshGrants[refreshToken]
+	delegatedLock.Unlock()
+	if !codeKept || !grantKept {
+		t.Fatalf("sweep removed live grants: code kept %t, refresh token kept %t", codeKept, grantKept)
+	}
+
+	SweepDelegatedGrants(Now().Add(91 * 24 * time.Hour).Unix())
+
+	delegatedLock.Lock()
+	_, codeKept = authorizationCodes[code]
+	_, grantKept = refreshGrants[refreshToken]
+	delegatedLock.Unlock()
+	if codeKept || grantKept {
+		t.Fatalf("sweep kept expired grants: code kept %t, refresh token kept %t", codeKept, grantKept)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// The network-level modes of a fault rule, which break the response instead of slowing it
+const (
+	// close the connection with a TCP reset before answering
+	ResetMode = "reset"
+	// announce a longer Content-Length than the body that is sent, then close
+	TruncateMode = "truncate"
+	// answer with chunked encoding whose chunk size is not hexadecimal
+	BadChunkedMode = "bad_chunked"
+	// send bytes that are not JSON, labelled as application/json
+	GarbageMode = "garbage"
+	// answer with no body at all
+	EmptyMode = "empty"
+)
+
+func isChaosMode(mode string) bool {
+	switch mode {
+	case ResetMode, TruncateMode, BadChunkedMode, GarbageMode, EmptyMode:
+		return true
+	}
+
+	return false
+}
+
+// chaosBody is the body the broken answers are made from, the rule's own or a plausible token response
+func chaosBody(rule *FaultRule) []byte {
+	switch body := rule.Body.(type) {
+	case nil:
+		body = map[string]interface{}{
+			"access_token": RandStringRunes(64),
+			"expires_in":   3599,
+			"token_type":   "Bearer",
+		}
+		encoded, _ := json.Marshal(body)
+		return encoded
+	case string:
+		return []byte(body)
+	default:
+		encoded, _ := json.Marshal(body)
+		return encoded
+	}
+}
+
+// hijack takes the raw connection over from the HTTP server, for answers net/http refuses to write
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, bool) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		log.Println("cannot take over the connection for a network fault")
+		return nil, nil, false
+	}
+
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("cannot take over the connection for a network fault: %s\n", err)
+		return nil, nil, false
+	}
+
+	return conn, buffer, true
+}
+
+// writeChaos answers with one of the network-level modes
+func writeChaos(w http.ResponseWriter, rule *FaultRule) {
+	status := rule.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+
+	switch rule.Mode {
+	case ResetMode:
+		conn, _, ok := hijack(w)
+		if !ok {
+			return
+		}
+		// with no linger, closing sends RST instead of FIN
+		if tcp, isTCP := conn.(*net.TCPConn); isTCP {
+			tcp.SetLinger(0)
+		}
+		conn.Close()
+
+	case TruncateMode:
+		conn, buffer, ok := hijack(w)
+		if !ok {
+			return
+		}
+		defer conn.Close()
+
+		body := chaosBody(rule)
+		buffer.WriteString(statusLine)
+		buffer.WriteString("Content-Type: application/json\r\n")
+		buffer.WriteString(fmt.Sprintf("Content-Length: %d\r\n", len(body)+512))
+		buffer.WriteString("Connection: close\r\n\r\n")
+		buffer.Write(body[:len(body)/2])
+		buffer.Flush()
+
+	case BadChunkedMode:
+		conn, buffer, ok := hijack(w)
+		if !ok {
+			return
+		}
+		defer conn.Close()
+
+		body := chaosBody(rule)
+		buffer.WriteString(statusLine)
+		buffer.WriteString("Content-Type: application/json\r\n")
+		buffer.WriteString("Transfer-Encoding: chunked\r\n")
+		buffer.WriteString("Connection: close\r\n\r\n")
+		buffer.WriteString("zz\r\n")
+		buffer.Write(body)
+		buffer.WriteString("\r\n")
+		buffer.Flush()
+
+	case GarbageMode:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte("\x00\xff\xfe<html>{\"access_token\": \x1b[0m not json"))
+
+	case EmptyMode:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(status)
+	}
+}
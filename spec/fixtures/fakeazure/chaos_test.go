@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// TestChaosModes breaks one token request per mode, over a real connection since most modes
+// take it over from net/http
+func TestChaosModes(t *testing.T) {
+	withDefaultConfig(t)
+
+	server := httptest.NewServer(testHandler)
+	defer server.Close()
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {"fake_client"},
+		"client_secret": {"fake_secret"},
+		"scope":         {"https://vault.azure.net/.default"},
+	}
+
+	// readBody makes a token request and returns its body, or the error that broke it
+	readBody := func() ([]byte, error) {
+		response, err := http.PostForm(server.URL+"/fake_tenant/oauth2/v2.0/token", form)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+
+		return ioutil.ReadAll(response.Body)
+	}
+
+	tests := []struct {
+		mode  string
+		check func(body []byte, err error) bool
+	}{
+		{ResetMode, func(body []byte, err error) bool { return err != nil }},
+		{TruncateMode, func(body []byte, err error) bool { return err != nil && len(body) > 0 }},
+		{BadChunkedMode, func(body []byte, err error) bool { return err != nil }},
+		{GarbageMode, func(body []byte, err error) bool {
+			var decoded map[string]interface{}
+			return err == nil && json.Unmarshal(body, &decoded) != nil
+		}},
+		{EmptyMode, func(body []byte, err error) bool { return err == nil && len(body) == 0 }},
+	}
+
+	for _, test := range tests {
+		recorder := serve(http.MethodPut, "/admin/faults/chaos", `{"method": "POST", "path": "/fake_tenant/oauth2/v2.0/token", "mode": "`+test.mode+`", "times": 1}`, nil)
+		expectStatus(t, recorder, http.StatusOK)
+
+		if body, err := readBody(); !test.check(body, err) {
+			t.Errorf("%s answered %q, error %v", test.mode, body, err)
+		}
+
+		// the rule fired once, so the next request is answered normally
+		var token OAuthResponse
+		body, err := readBody()
+		if err != nil || json.Unmarshal(body, &token) != nil || token.AccessToken == "" {
+			t.Errorf("request after the %s fault failed: %q, error %v", test.mode, body, err)
+		}
+	}
+}
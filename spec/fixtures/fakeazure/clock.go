@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// VirtualClock is the time as seen by every expiry check in fakeazure.
+// It follows the wall clock, shifted by an offset, until it is frozen.
+type VirtualClock struct {
+	lock   sync.Mutex
+	offset time.Duration
+	frozen *time.Time
+}
+
+type ClockRequest struct {
+	Seconds int64 `json:"seconds"`
+	Now     int64 `json:"now"`
+}
+
+type ClockResponse struct {
+	Now    int64 `json:"now"`
+	Frozen bool  `json:"frozen"`
+}
+
+var clock = &VirtualClock{}
+
+// fixtureLifetime is how long after Config.FixtureEpoch the fixture secret and certificate expire
+const fixtureLifetime = 10 * 365 * 24 * 60 * 60
+
+// Now is the virtual time; use it instead of time.Now() for anything a test may want to fast-forward
+func Now() time.Time {
+	return clock.Now()
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.frozen != nil {
+		return *c.frozen
+	}
+
+	return time.Now().Add(c.offset)
+}
+
+// Freeze stops the clock at the current virtual time
+func (c *VirtualClock) Freeze() {
+	now := c.Now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.frozen = &now
+}
+
+// Advance moves the clock forward, whether or not it is frozen
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.frozen != nil {
+		advanced := c.frozen.Add(d)
+		c.frozen = &advanced
+	}
+	c.offset += d
+}
+
+// Set jumps to the given time, and keeps the clock frozen if it was
+func (c *VirtualClock) Set(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.frozen != nil {
+		c.frozen = &t
+	}
+	c.offset = time.Until(t)
+}
+
+// Reset goes back to the wall clock
+func (c *VirtualClock) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.frozen = nil
+	c.offset = 0
+}
+
+func writeClock(w http.ResponseWriter) {
+	clock.lock.Lock()
+	frozen := clock.frozen != nil
+	clock.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ClockResponse{
+		Now:    Now().Unix(),
+		Frozen: frozen,
+	})
+}
+
+func AdminClockGet(w http.ResponseWriter, r *http.Request) {
+	writeClock(w)
+}
+
+func AdminClockFreeze(w http.ResponseWriter, r *http.Request) {
+	clock.Freeze()
+	writeClock(w)
+}
+
+// AdminClockAdvance moves the clock forward by {"seconds": n}
+func AdminClockAdvance(w http.ResponseWriter, r *http.Request) {
+	var request ClockRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "could not parse the clock request: "+err.Error())
+		return
+	}
+
+	if request.Seconds < 0 {
+		writeAdminError(w, http.StatusBadRequest, "seconds must not be negative, use set to go back in time")
+		return
+	}
+
+	clock.Advance(time.Duration(request.Seconds) * time.Second)
+	writeClock(w)
+}
+
+// AdminClockSet jumps to {"now": <unix seconds>}
+func AdminClockSet(w http.ResponseWriter, r *http.Request) {
+	var request ClockRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "could not parse the clock request: "+err.Error())
+		return
+	}
+
+	if request.Now <= 0 {
+		writeAdminError(w, http.StatusBadRequest, "now is required, in seconds since the epoch")
+		return
+	}
+
+	clock.Set(time.Unix(request.Now, 0))
+	writeClock(w)
+}
+
+func AdminClockReset(w http.ResponseWriter, r *http.Request) {
+	clock.Reset()
+	writeClock(w)
+}
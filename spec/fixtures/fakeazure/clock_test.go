@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminClock calls one of the clock endpoints and returns the clock it answers with
+func adminClock(t *testing.T, method string, path string, body string) (int64, bool) {
+	t.Helper()
+
+	recorder := serve(method, "/admin/clock"+path, body, nil)
+	expectStatus(t, recorder, http.StatusOK)
+
+	answer := decodeBody(t, recorder)
+	now, _ := answer["now"].(float64)
+
+	return int64(now), answer["frozen"] == true
+}
+
+func TestVirtualClock(t *testing.T) {
+	withDefaultConfig(t)
+	t.Cleanup(clock.Reset)
+
+	token, _ := IssueAppToken(DefaultCloud(), "fake_tenant", "fake_client", "https://vault.azure.net", "1.0", Now().Unix(), 60)
+
+	frozenAt, frozen := adminClock(t, http.MethodPost, "/freeze", "")
+	if !frozen {
+		t.Fatal("clock is not frozen after freeze")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if now, _ := adminClock(t, http.MethodGet, "", ""); now != frozenAt {
+		t.Fatalf("frozen clock moved from %d to %d", frozenAt, now)
+	}
+
+	// skipping past the token's lifetime expires it without waiting
+	now, frozen := adminClock(t, http.MethodPost, "/advance", `{"seconds": 3600}`)
+	if now != frozenAt+3600 || !frozen {
+		t.Fatalf("advance by an hour from %d answered %d, frozen %t", frozenAt, now, frozen)
+	}
+
+	recorder := getSecretWith(token)
+	expectStatus(t, recorder, http.StatusUnauthorized)
+	if !strings.Contains(recorder.Body.String(), "Token expired") {
+		t.Fatalf("token past its lifetime was not answered as expired: %s", recorder.Body.String())
+	}
+
+	if now, frozen := adminClock(t, http.MethodPost, "/set", `{"now": 1700000000}`); now != 1700000000 || !frozen {
+		t.Fatalf("set answered %d, frozen %t", now, frozen)
+	}
+
+	expectStatus(t, serve(http.MethodPost, "/admin/clock/advance", `{"seconds": -1}`, nil), http.StatusBadRequest)
+	expectStatus(t, serve(http.MethodPost, "/admin/clock/set", `{}`, nil), http.StatusBadRequest)
+
+	now, frozen = adminClock(t, http.MethodPost, "/reset", "")
+	if frozen || now < time.Now().Unix()-1 || now > time.Now().Unix()+1 {
+		t.Fatalf("reset clock answered %d, frozen %t, want the wall clock", now, frozen)
+	}
+}
+
+func TestFixturesFollowTheirEpoch(t *testing.T) {
+	withDefaultConfig(t)
+
+	attributes := func() map[string]interface{} {
+		token, _ := IssueAppToken(DefaultCloud(), "fake_tenant", "fake_client", "https://vault.azure.net", "1.0", Now().Unix(), 3600)
+		recorder := getSecretWith(token)
+		expectStatus(t, recorder, http.StatusOK)
+
+		attributes, _ := decodeBody(t, recorder)["attributes"].(map[string]interface{})
+		return attributes
+	}
+
+	first := attributes()
+	if first["created"] != float64(defaultFixtureEpoch) || first["exp"] != float64(defaultFixtureEpoch+fixtureLifetime) {
+		t.Fatalf("secret was not created at the default epoch: %v", first)
+	}
+
+	// the epoch does not follow the clock, so the fixtures look the same later on
+	clock.Advance(24 * time.Hour)
+	t.Cleanup(clock.Reset)
+	if again := attributes(); again["created"] != first["created"] || again["updated"] != first["updated"] {
+		t.Fatalf("secret attributes changed with the clock: %v, then %v", first, again)
+	}
+
+	Config.FixtureEpoch = 1700000000
+	if configured := attributes(); configured["created"] != float64(1700000000) {
+		t.Fatalf("secret was not created at the configured epoch: %v", configured)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// CloudProfile is an Azure cloud: where its users sign in, and how its Key Vaults are addressed
+type CloudProfile struct {
+	Name              string `json:"name"`
+	AuthorityHost     string `json:"authority_host"`
+	IssuerHost        string `json:"issuer_host"`
+	CloudInstanceName string `json:"cloud_instance_name"`
+	KeyVaultSuffix    string `json:"keyvault_dns_suffix"`
+	KeyVaultAudience  string `json:"keyvault_audience"`
+}
+
+// ListenerConfig is an extra address fakeazure listens on, playing a given cloud
+type ListenerConfig struct {
+	Address string `json:"address"`
+	Cloud   string `json:"cloud"`
+}
+
+var CloudProfiles = []*CloudProfile{
+	{
+		Name:              "AzureCloud",
+		AuthorityHost:     "https://login.microsoftonline.com",
+		IssuerHost:        "https://sts.windows.net",
+		CloudInstanceName: "microsoftonline.com",
+		KeyVaultSuffix:    "vault.azure.net",
+		KeyVaultAudience:  "https://vault.azure.net",
+	},
+	{
+		Name:              "AzureUSGovernment",
+		AuthorityHost:     "https://login.microsoftonline.us",
+		IssuerHost:        "https://login.microsoftonline.us",
+		CloudInstanceName: "microsoftonline.us",
+		KeyVaultSuffix:    "vault.usgovcloudapi.net",
+		KeyVaultAudience:  "https://vault.usgovcloudapi.net",
+	},
+	{
+		Name:              "AzureChinaCloud",
+		AuthorityHost:     "https://login.chinacloudapi.cn",
+		IssuerHost:        "https://sts.chinacloudapi.cn",
+		CloudInstanceName: "chinacloudapi.cn",
+		KeyVaultSuffix:    "vault.azure.cn",
+		KeyVaultAudience:  "https://vault.azure.cn",
+	},
+}
+
+// keyVaultAppID is the application ID of Key Vault, which it accepts as an audience in every cloud
+const keyVaultAppID = "cfa8b339-82a2-471a-a3c9-0fc0be7a4093"
+
+type cloudContextKey struct{}
+
+// FindCloudProfile looks a cloud up by name, case-insensitively
+func FindCloudProfile(name string) *CloudProfile {
+	for _, profile := range CloudProfiles {
+		if strings.EqualFold(profile.Name, name) {
+			return profile
+		}
+	}
+
+	return nil
+}
+
+// CloudFor returns the cloud a request is made to: the one owning the vault DNS suffix it was
+// addressed to, otherwise the cloud of the listener it came in on
+func CloudFor(r *http.Request) *CloudProfile {
+	host := hostWithoutPort(r.Host)
+	for _, profile := range CloudProfiles {
+		if strings.HasSuffix(strings.ToLower(host), "."+profile.KeyVaultSuffix) {
+			return profile
+		}
+	}
+
+	if profile, ok := r.Context().Value(cloudContextKey{}).(*CloudProfile); ok {
+		return profile
+	}
+
+	return DefaultCloud()
+}
+
+// DefaultCloud is the cloud the main listener plays
+func DefaultCloud() *CloudProfile {
+	if profile := FindCloudProfile(Config.Cloud); profile != nil {
+		return profile
+	}
+
+	return CloudProfiles[0]
+}
+
+// WithCloud serves a listener as the given cloud
+func WithCloud(profile *CloudProfile, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cloudContextKey{}, profile)))
+	})
+}
+
+// VaultBaseURL is the vault URI as the client addressed it: `https://{vault}.{suffix}` when reached
+// by its DNS name, or fakeazure's own `/keyvault/{vault}` path otherwise
+func VaultBaseURL(r *http.Request, vaultName string) string {
+	host := hostWithoutPort(r.Host)
+	if strings.HasSuffix(strings.ToLower(host), "."+CloudFor(r).KeyVaultSuffix) {
+		return "https://" + host
+	}
+
+	return "http://" + r.Host + "/keyvault/" + vaultName
+}
+
+// AudienceAccepted tells whether Key Vault in this cloud accepts a token with the given `aud`
+func (c *CloudProfile) AudienceAccepted(audience string) bool {
+	return strings.TrimSuffix(audience, "/") == c.KeyVaultAudience || audience == keyVaultAppID
+}
+
+// Issuer is the `iss` of the cloud's tokens for a tenant, in the v1 or v2.0 format
+func (c *CloudProfile) Issuer(tenantID string, version string) string {
+	if version == "2.0" {
+		return c.AuthorityHost + "/" + tenantID + "/v2.0"
+	}
+
+	return c.IssuerHost + "/" + tenantID + "/"
+}
+
+// IssuerAccepted tells whether Key Vault in this cloud accepts a token with the given `iss` for the tenant
+func (c *CloudProfile) IssuerAccepted(issuer string, tenantID string) bool {
+	return issuer == c.Issuer(tenantID, "1.0") || issuer == c.Issuer(tenantID, "2.0")
+}
+
+func hostWithoutPort(host string) string {
+	if colon := strings.LastIndex(host, ":"); colon >= 0 && !strings.HasSuffix(host, "]") {
+		return host[:colon]
+	}
+
+	return host
+}
+
+// ListenForClouds starts the extra listeners from the config, each serving as its cloud
+func ListenForClouds(handler http.Handler) {
+	for _, listener := range Config.Listeners {
+		profile := FindCloudProfile(listener.Cloud)
+		if profile == nil {
+			log.Fatalf("unknown cloud %q for listener %s", listener.Cloud, listener.Address)
+		}
+
+		go func(address string, profile *CloudProfile) {
+			log.Printf("Starting fakeazure %s listener on %s\n", profile.Name, address)
+			log.Fatal(http.ListenAndServe(address, WithCloud(profile, handler)))
+		}(listener.Address, profile)
+	}
+}
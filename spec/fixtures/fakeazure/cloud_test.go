@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// serveCloud sends a request to a listener playing the named cloud
+func serveCloud(cloud string, method string, target string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	recorder := httptest.NewRecorder()
+	WithCloud(FindCloudProfile(cloud), testHandler).ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func TestIssuerPerCloud(t *testing.T) {
+	withDefaultConfig(t)
+
+	tests := []struct {
+		cloud    string
+		issuerV1 string
+		issuerV2 string
+	}{
+		{"AzureCloud", "https://sts.windows.net/fake_tenant/", "https://login.microsoftonline.com/fake_tenant/v2.0"},
+		{"AzureUSGovernment", "https://login.microsoftonline.us/fake_tenant/", "https://login.microsoftonline.us/fake_tenant/v2.0"},
+		{"AzureChinaCloud", "https://sts.chinacloudapi.cn/fake_tenant/", "https://login.chinacloudapi.cn/fake_tenant/v2.0"},
+	}
+
+	// Key Vault's application ID is a valid audience in every cloud
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {"fake_client"},
+		"client_secret": {"fake_secret"},
+		"scope":         {keyVaultAppID + "/.default"},
+	}
+
+	for _, test := range tests {
+		recorder := serveCloud(test.cloud, http.MethodPost, "/fake_tenant/oauth2/v2.0/token", form.Encode(), map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+		expectStatus(t, recorder, http.StatusOK)
+		if claims := accessTokenClaims(t, decodeBody(t, recorder)); claims.String("iss") != test.issuerV1 {
+			t.Errorf("%s token has issuer %s, want %s", test.cloud, claims.String("iss"), test.issuerV1)
+		}
+
+		recorder = serveCloud(test.cloud, http.MethodGet, "/fake_tenant/v2.0/.well-known/openid-configuration", "", nil)
+		expectStatus(t, recorder, http.StatusOK)
+		if issuer := decodeBody(t, recorder)["issuer"]; issuer != test.issuerV2 {
+			t.Errorf("%s v2.0 metadata has issuer %v, want %s", test.cloud, issuer, test.issuerV2)
+		}
+
+		recorder = serveCloud(test.cloud, http.MethodGet, "/fake_tenant/.well-known/openid-configuration", "", nil)
+		expectStatus(t, recorder, http.StatusOK)
+		if issuer := decodeBody(t, recorder)["issuer"]; issuer != test.issuerV1 {
+			t.Errorf("%s v1 metadata has issuer %v, want %s", test.cloud, issuer, test.issuerV1)
+		}
+	}
+}
+
+func TestVaultRefusesIssuerOfAnotherCloud(t *testing.T) {
+	withDefaultConfig(t)
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {"fake_client"},
+		"client_secret": {"fake_secret"},
+		"scope":         {keyVaultAppID + "/.default"},
+	}
+	recorder := serveCloud("AzureUSGovernment", http.MethodPost, "/fake_tenant/oauth2/v2.0/token", form.Encode(), map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+	expectStatus(t, recorder, http.StatusOK)
+	authorization := map[string]string{"Authorization": "Bearer " + decodeBody(t, recorder)["access_token"].(string)}
+
+	// the audience suits every cloud, so only the issuer gives the token away
+	recorder = serve(http.MethodGet, "http://jack-vault.vault.azure.net/secrets/demo?api-version=7.4", "", authorization)
+	expectStatus(t, recorder, http.StatusUnauthorized)
+	if !strings.Contains(recorder.Body.String(), "AKV10032: Invalid issuer") {
+		t.Fatalf("public vault did not refuse a Government token with AKV10032: %s", recorder.Body.String())
+	}
+
+	recorder = serve(http.MethodGet, "http://jack-vault.vault.usgovcloudapi.net/secrets/demo?api-version=7.4", "", authorization)
+	expectStatus(t, recorder, http.StatusOK)
+	if id := decodeBody(t, recorder)["id"]; !strings.HasPrefix(id.(string), "https://jack-vault.vault.usgovcloudapi.net/secrets/demo/") {
+		t.Fatalf("secret ID does not use the vault's Government DNS name: %v", id)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FakeAzureConfig holds everything that tests can tune without recompiling.
+// The defaults line up with the fixtures used throughout the spec suite.
+type FakeAzureConfig struct {
+	DefaultTenantID   string                  `json:"default_tenant_id"`
+	AuthorityHost     string                  `json:"authority_host"`
+	AuthorityAliases  []string                `json:"authority_aliases"`
+	Cloud             string                  `json:"cloud"`
+	FixtureEpoch      int64                   `json:"fixture_epoch"`
+	Listeners         []*ListenerConfig       `json:"listeners"`
+	ManagedIdentities ManagedIdentitiesConfig `json:"managed_identities"`
+	AppService        AppServiceConfig        `json:"app_service"`
+	Arc               ArcConfig               `json:"arc"`
+	Users             []*TestUser             `json:"users"`
+	DeviceCode        DeviceCodeConfig        `json:"device_code"`
+	Applications      []*Application          `json:"applications"`
+	Vaults            []*Vault                `json:"vaults"`
+	RoleAssignments   []*RoleAssignment       `json:"role_assignments"`
+	RoleDefinitions   []*RoleDefinition       `json:"role_definitions"`
+	ManagementGroups  []*ManagementGroup      `json:"management_groups"`
+	TokenStore        TokenStoreConfig        `json:"token_store"`
+	FaultRules        []*FaultRule            `json:"fault_rules"`
+	Throttling        ThrottlingConfig        `json:"throttling"`
+	ClientFaults      map[string]string       `json:"client_faults"`
+	Proxy             ProxyConfig             `json:"proxy"`
+}
+
+type ManagedIdentitiesConfig struct {
+	SystemAssigned *ManagedIdentity   `json:"system_assigned"`
+	UserAssigned   []*ManagedIdentity `json:"user_assigned"`
+}
+
+// AppServiceConfig mirrors the IDENTITY_HEADER secret handed to App Service and Functions hosts
+type AppServiceConfig struct {
+	IdentityHeader string `json:"identity_header"`
+}
+
+// ArcConfig says where the challenge .key files are written, normally /var/opt/azcmagent/tokens
+type ArcConfig struct {
+	KeyDirectory string `json:"key_directory"`
+}
+
+// DeviceCodeConfig sets the polling interval and lifetime, both in seconds, of device codes.
+// An interval of 0 turns off slow_down answers.
+type DeviceCodeConfig struct {
+	Interval  int `json:"interval"`
+	ExpiresIn int `json:"expires_in"`
+}
+
+// TokenStoreConfig sets how often, in seconds, expired tokens are swept, and how long after
+// expiry they are kept so that they are still answered as expired rather than unknown
+type TokenStoreConfig struct {
+	SweepInterval int `json:"sweep_interval"`
+	Retention     int `json:"retention"`
+}
+
+// Application is an app registration, known to Key Vault by its service principal object ID
+type Application struct {
+	ClientID string `json:"client_id"`
+	ObjectID string `json:"object_id"`
+}
+
+// Vault is a Key Vault instance. Vaults that are not configured are created on first use
+// in the default subscription and resource group.
+type Vault struct {
+	Name           string `json:"name"`
+	SubscriptionID string `json:"subscription_id"`
+	ResourceGroup  string `json:"resource_group"`
+	Location       string `json:"location"`
+	TenantID       string `json:"tenant_id"`
+
+	// the authorization settings keep their ARM property names
+	EnableRbacAuthorization *bool           `json:"enableRbacAuthorization"`
+	AccessPolicies          []*AccessPolicy `json:"accessPolicies"`
+}
+
+// TestUser is a user that the authorize endpoint signs in, and consents for, without a prompt
+type TestUser struct {
+	UPN      string `json:"upn"`
+	ObjectID string `json:"object_id"`
+	Name     string `json:"name"`
+	TenantID string `json:"tenant_id"`
+}
+
+type ManagedIdentity struct {
+	ClientID   string `json:"client_id"`
+	ObjectID   string `json:"object_id"`
+	ResourceID string `json:"msi_res_id"`
+	TenantID   string `json:"tenant_id"`
+}
+
+const defaultSubscriptionID = "00000000-0000-0000-0000-000000000000"
+const defaultResourceGroup = "fake-rg"
+
+// defaultFixtureEpoch is 2023-01-01T00:00:00Z, so the fixtures look the same on every run
+const defaultFixtureEpoch = 1672531200
+
+var Config *FakeAzureConfig = DefaultConfig()
+
+// configLock guards the parts of Config that change at runtime through the admin API
+var configLock sync.Mutex
+
+func DefaultConfig() *FakeAzureConfig {
+	return &FakeAzureConfig{
+		DefaultTenantID: "fake_tenant",
+		Cloud:           "AzureCloud",
+		FixtureEpoch:    defaultFixtureEpoch,
+		ManagedIdentities: ManagedIdentitiesConfig{
+			SystemAssigned: &ManagedIdentity{
+				ClientID:   "a9b8c7d6-0000-4000-8000-000000000001",
+				ObjectID:   "f1e2d3c4-0000-4000-8000-000000000001",
+				ResourceID: "/subscriptions/" + defaultSubscriptionID + "/resourceGroups/" + defaultResourceGroup + "/providers/Microsoft.Compute/virtualMachines/fake-vm",
+			},
+			UserAssigned: []*ManagedIdentity{
+				{
+					ClientID:   "fake_client",
+					ObjectID:   "f1e2d3c4-0000-4000-8000-000000000002",
+					ResourceID: "/subscriptions/" + defaultSubscriptionID + "/resourceGroups/" + defaultResourceGroup + "/providers/Microsoft.ManagedIdentity/userAssignedIdentities/fake-identity",
+				},
+			},
+		},
+		AppService: AppServiceConfig{
+			IdentityHeader: "fake_identity_header",
+		},
+		Arc: ArcConfig{
+			KeyDirectory: filepath.Join(os.TempDir(), "fakeazure-arc"),
+		},
+		DeviceCode: DeviceCodeConfig{
+			Interval:  5,
+			ExpiresIn: 900,
+		},
+		TokenStore: TokenStoreConfig{
+			SweepInterval: 60,
+			Retention:     300,
+		},
+		Proxy: ProxyConfig{
+			CassetteDir: defaultCassetteDir,
+		},
+		Applications: []*Application{
+			{
+				ClientID: "fake_client",
+				ObjectID: "5e6f7a8b-0000-4000-8000-000000000001",
+			},
+		},
+		Vaults: []*Vault{
+			{
+				Name: "jack-vault",
+			},
+		},
+		RoleAssignments: []*RoleAssignment{
+			{
+				ID:               "fake-client-administrator",
+				PrincipalID:      "5e6f7a8b-0000-4000-8000-000000000001",
+				RoleDefinitionID: "Key Vault Administrator",
+				Scope:            "/subscriptions/" + defaultSubscriptionID,
+			},
+			{
+				ID:               "system-assigned-administrator",
+				PrincipalID:      "f1e2d3c4-0000-4000-8000-000000000001",
+				RoleDefinitionID: "Key Vault Administrator",
+				Scope:            "/subscriptions/" + defaultSubscriptionID,
+			},
+			{
+				ID:               "user-assigned-administrator",
+				PrincipalID:      "f1e2d3c4-0000-4000-8000-000000000002",
+				RoleDefinitionID: "Key Vault Administrator",
+				Scope:            "/subscriptions/" + defaultSubscriptionID,
+			},
+			{
+				ID:               "fake-user-administrator",
+				PrincipalID:      "0b1c2d3e-0000-4000-8000-000000000001",
+				RoleDefinitionID: "Key Vault Administrator",
+				Scope:            "/subscriptions/" + defaultSubscriptionID,
+			},
+		},
+		Users: []*TestUser{
+			{
+				UPN:      "fake_user@fake_tenant.onmicrosoft.com",
+				ObjectID: "0b1c2d3e-0000-4000-8000-000000000001",
+				Name:     "Fake User",
+			},
+		},
+	}
+}
+
+// LoadConfig replaces the defaults with the JSON file named by FAKEAZURE_CONFIG, if set.
+// Sections missing from the file keep their default values.
+func LoadConfig() {
+	path := os.Getenv("FAKEAZURE_CONFIG")
+	if path == "" {
+		return
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("could not read fakeazure config %s: %s", path, err)
+	}
+
+	if err := json.Unmarshal(raw, Config); err != nil {
+		log.Fatalf("could not parse fakeazure config %s: %s", path, err)
+	}
+
+	if err := Config.Proxy.validate(); err != nil {
+		log.Fatalf("invalid proxy settings in fakeazure config %s: %s", path, err)
+	}
+
+	log.Printf("Loaded fakeazure config from %s\n", path)
+}
+
+// FindUser looks a test user up by object ID or user principal name
+func FindUser(id string) *TestUser {
+	for _, user := range Config.Users {
+		if user.ObjectID == id || strings.EqualFold(user.UPN, id) {
+			return user
+		}
+	}
+
+	return nil
+}
+
+// TenantFor returns the tenant a managed identity lives in
+func (mi *ManagedIdentity) TenantFor() string {
+	if mi.TenantID != "" {
+		return mi.TenantID
+	}
+
+	return Config.DefaultTenantID
+}
+
+func (u *TestUser) TenantFor() string {
+	if u.TenantID != "" {
+		return u.TenantID
+	}
+
+	return Config.DefaultTenantID
+}
+
+// FindApplication looks an app registration up by client ID
+func FindApplication(clientID string) *Application {
+	for _, app := range Config.Applications {
+		if app.ClientID == clientID {
+			return app
+		}
+	}
+
+	return nil
+}
+
+// PrincipalIDFor returns the service principal object ID of an app, derived from the client ID if unregistered
+func PrincipalIDFor(clientID string) string {
+	if app := FindApplication(clientID); app != nil && app.ObjectID != "" {
+		return app.ObjectID
+	}
+
+	return ObjectIDFor(clientID)
+}
+
+// FindVault returns a copy of the configured vault, creating it with defaults on first use.
+// Changes to the copy only take effect through ReplaceVault.
+func FindVault(name string) *Vault {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	for _, vault := range Config.Vaults {
+		if strings.EqualFold(vault.Name, name) {
+			return vault.withDefaults().clone()
+		}
+	}
+
+	vault := (&Vault{Name: name}).withDefaults()
+	Config.Vaults = append(Config.Vaults, vault)
+
+	return vault.clone()
+}
+
+// ReplaceVault swaps the configured vault of the same name for the given one
+func ReplaceVault(replacement *Vault) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	for i, vault := range Config.Vaults {
+		if strings.EqualFold(vault.Name, replacement.Name) {
+			Config.Vaults[i] = replacement
+			return
+		}
+	}
+
+	Config.Vaults = append(Config.Vaults, replacement)
+}
+
+// clone copies the vault deeply, so that decoding into the copy cannot reach the original
+func (v *Vault) clone() *Vault {
+	copied := *v
+
+	if v.EnableRbacAuthorization != nil {
+		enabled := *v.EnableRbacAuthorization
+		copied.EnableRbacAuthorization = &enabled
+	}
+
+	if v.AccessPolicies != nil {
+		copied.AccessPolicies = make([]*AccessPolicy, len(v.AccessPolicies))
+		for i, policy := range v.AccessPolicies {
+			copied.AccessPolicies[i] = policy.clone()
+		}
+	}
+
+	return &copied
+}
+
+func (v *Vault) withDefaults() *Vault {
+	if v.SubscriptionID == "" {
+		v.SubscriptionID = defaultSubscriptionID
+	}
+	if v.ResourceGroup == "" {
+		v.ResourceGroup = defaultResourceGroup
+	}
+	if v.Location == "" {
+		v.Location = "eastus"
+	}
+
+	return v
+}
+
+// TenantFor returns the tenant a vault belongs to; only tokens issued by that tenant are accepted
+func (v *Vault) TenantFor() string {
+	if v.TenantID != "" {
+		return v.TenantID
+	}
+
+	return Config.DefaultTenantID
+}
+
+// RbacEnabled is true unless the vault has been switched to access policies
+func (v *Vault) RbacEnabled() bool {
+	return v.EnableRbacAuthorization == nil || *v.EnableRbacAuthorization
+}
+
+// ResourceID is the ARM ID that role assignments are scoped against
+func (v *Vault) ResourceID() string {
+	return "/subscriptions/" + v.SubscriptionID + "/resourceGroups/" + v.ResourceGroup + "/providers/Microsoft.KeyVault/vaults/" + v.Name
+}
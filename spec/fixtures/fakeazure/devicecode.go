@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// DeviceAuthorization tracks one device code until it is approved, declined or expires
+type DeviceAuthorization struct {
+	ClientID  string
+	TenantID  string
+	UserCode  string
+	Scopes    []string
+	Interval  int
+	ExpiresAt int64
+	LastPoll  int64
+	User      *TestUser
+	Declined  bool
+}
+
+type DeviceCodeResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+	Message         string `json:"message"`
+}
+
+var deviceAuthorizations = map[string]*DeviceAuthorization{}
+var deviceAuthorizationsLock sync.Mutex
+
+var userCodeRunes = []rune("ABCDEFGHJKLMNPQRSTUVWXYZ23456789")
+
+func newUserCode() string {
+	code := make([]rune, 9)
+	for i := range code {
+		code[i] = userCodeRunes[rand.Intn(len(userCodeRunes))]
+	}
+
+	return string(code)
+}
+
+func OAuthDeviceCodePost(w http.ResponseWriter, r *http.Request) {
+	tenantID := mux.Vars(r)["tenantId"]
+	if !parseOAuthForm(w, r, "client_id") {
+		return
+	}
+
+	clientID := r.PostForm.Get("client_id")
+	if clientID == "" {
+		AADMissingParameter.Write(w, "client_id")
+		return
+	}
+
+	scope := r.PostForm.Get("scope")
+	if scope == "" {
+		AADMissingParameter.Write(w, "scope")
+		return
+	}
+
+	deviceCode := RandStringRunes(96)
+	authorization := &DeviceAuthorization{
+		ClientID:  clientID,
+		TenantID:  tenantID,
+		UserCode:  newUserCode(),
+		Scopes:    strings.Fields(scope),
+		Interval:  Config.DeviceCode.Interval,
+		ExpiresAt: Now().Unix() + int64(Config.DeviceCode.ExpiresIn),
+	}
+
+	deviceAuthorizationsLock.Lock()
+	deviceAuthorizations[deviceCode] = authorization
+	deviceAuthorizationsLock.Unlock()
+
+	verificationURI := fmt.Sprintf("http://%s/devicelogin", r.Host)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(DeviceCodeResponse{
+		DeviceCode:      deviceCode,
+		UserCode:        authorization.UserCode,
+		VerificationURI: verificationURI,
+		ExpiresIn:       Config.DeviceCode.ExpiresIn,
+		Interval:        authorization.Interval,
+		Message:         fmt.Sprintf("To sign in, use a web browser to open the page %s and enter the code %s to authenticate.", verificationURI, authorization.UserCode),
+	})
+}
+
+func oauthDeviceCodeGrant(w http.ResponseWriter, r *http.Request, tenantID string, lifetime int) {
+	deviceCode := r.PostForm.Get("device_code")
+	if deviceCode == "" {
+		AADMissingParameter.Write(w, "device_code")
+		return
+	}
+
+	now := Now().Unix()
+
+	deviceAuthorizationsLock.Lock()
+	stored, ok := deviceAuthorizations[deviceCode]
+	// another client or tenant must not touch the authorization, let alone consume it
+	if ok && (stored.ClientID != r.PostForm.Get("client_id") || stored.TenantID != tenantID) {
+		ok = false
+	}
+
+	var tooFast bool
+	var authorization DeviceAuthorization
+	if ok {
+		tooFast = stored.Interval > 0 && stored.LastPoll > 0 && now-stored.LastPoll < int64(stored.Interval)
+		if tooFast {
+			stored.Interval += 5
+		}
+		stored.LastPoll = now
+
+		// an approved authorization can only be redeemed once
+		if stored.User != nil && !stored.Declined && now <= stored.ExpiresAt {
+			delete(deviceAuthorizations, deviceCode)
+		}
+
+		// answer from a copy, as the admin API may approve or decline it meanwhile
+		authorization = *stored
+	}
+	deviceAuthorizationsLock.Unlock()
+
+	switch {
+	case !ok:
+		AADInvalidGrant.Write(w)
+		return
+
+	case now > authorization.ExpiresAt:
+		AADDeviceCodeExpired.Write(w)
+		return
+
+	case authorization.Declined:
+		AADAuthorizationDeclined.Write(w)
+		return
+
+	case authorization.User != nil:
+		writeDelegatedTokens(w, CloudFor(r), authorization.ClientID, authorization.TenantID, authorization.User, authorization.Scopes, "", lifetime)
+		return
+
+	case tooFast:
+		AADSlowDown.Write(w)
+		return
+	}
+
+	AADAuthorizationPending.Write(w)
+}
+
+// findDeviceAuthorization looks a pending authorization up by the user code shown to the person signing in
+func findDeviceAuthorization(userCode string) *DeviceAuthorization {
+	for _, authorization := range deviceAuthorizations {
+		if strings.EqualFold(authorization.UserCode, userCode) {
+			return authorization
+		}
+	}
+
+	return nil
+}
+
+// AdminDeviceCodeApprove stands in for the user entering the code in a browser.
+// The body may name the user to sign in as `{"user": "<upn or object id>"}`.
+func AdminDeviceCodeApprove(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		User string `json:"user"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	user := signInUser(body.User)
+	if user == nil {
+		writeAdminError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	deviceAuthorizationsLock.Lock()
+	authorization := findDeviceAuthorization(mux.Vars(r)["userCode"])
+	if authorization != nil {
+		authorization.User = user
+	}
+	deviceAuthorizationsLock.Unlock()
+
+	if authorization == nil {
+		writeAdminError(w, http.StatusNotFound, "user code not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func AdminDeviceCodeDecline(w http.ResponseWriter, r *http.Request) {
+	deviceAuthorizationsLock.Lock()
+	authorization := findDeviceAuthorization(mux.Vars(r)["userCode"])
+	if authorization != nil {
+		authorization.Declined = true
+	}
+	deviceAuthorizationsLock.Unlock()
+
+	if authorization == nil {
+		writeAdminError(w, http.StatusNotFound, "user code not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDeviceCodeFlow(t *testing.T) {
+	withDefaultConfig(t)
+
+	// like the token endpoint, only form bodies are read
+	recorder := serve(http.MethodPost, "/fake_tenant/oauth2/v2.0/devicecode", `{"client_id":"fake_client","scope":"openid"}`, map[string]string{"Content-Type": "application/json"})
+	expectStatus(t, recorder, http.StatusBadRequest)
+	expectAADError(t, recorder, 900144)
+
+	recorder = postForm("/fake_tenant/oauth2/v2.0/devicecode", url.Values{"client_id": {"fake_client"}, "scope": {"openid"}})
+	expectStatus(t, recorder, http.StatusOK)
+	authorization := decodeBody(t, recorder)
+
+	poll := func(clientID string) *httptest.ResponseRecorder {
+		return postForm("/fake_tenant/oauth2/v2.0/token", url.Values{
+			"grant_type":  {deviceCodeGrantType},
+			"client_id":   {clientID},
+			"device_code": {authorization["device_code"].(string)},
+		})
+	}
+
+	recorder = poll("fake_client")
+	expectStatus(t, recorder, http.StatusBadRequest)
+	if body := decodeBody(t, recorder); body["error"] != "authorization_pending" {
+		t.Fatalf("code that was not approved yet is not pending: %v", body)
+	}
+
+	expectStatus(t, serve(http.MethodPost, "/admin/devicecodes/"+authorization["user_code"].(string)+"/approve", "", nil), http.StatusNoContent)
+
+	// another client cannot redeem the code, nor use it up
+	recorder = poll("other_client")
+	expectStatus(t, recorder, http.StatusBadRequest)
+	expectAADError(t, recorder, 70000)
+
+	// the real authority waits for the polling interval, but the clock has not moved, so wind it forward
+	clock.Advance(time.Duration(Config.DeviceCode.Interval) * time.Second)
+	t.Cleanup(clock.Reset)
+
+	recorder = poll("fake_client")
+	expectStatus(t, recorder, http.StatusOK)
+	if claims := accessTokenClaims(t, decodeBody(t, recorder)); claims.String("oid") != "0b1c2d3e-0000-4000-8000-000000000001" {
+		t.Fatalf("token is not for the user who approved the code: %v", claims)
+	}
+
+	recorder = poll("fake_client")
+	expectStatus(t, recorder, http.StatusBadRequest)
+	expectAADError(t, recorder, 70000)
+}
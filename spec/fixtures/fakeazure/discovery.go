@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// InstanceMetadata is one entry of the instance discovery answer: a cloud and the hosts it is known by
+type InstanceMetadata struct {
+	PreferredNetwork string   `json:"preferred_network"`
+	PreferredCache   string   `json:"preferred_cache"`
+	Aliases          []string `json:"aliases"`
+}
+
+type InstanceDiscoveryResponse struct {
+	TenantDiscoveryEndpoint string              `json:"tenant_discovery_endpoint"`
+	APIVersion              string              `json:"api-version"`
+	Metadata                []*InstanceMetadata `json:"metadata"`
+}
+
+type OpenIDConfiguration struct {
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	JwksURI                           string   `json:"jwks_uri"`
+	ResponseModesSupported            []string `json:"response_modes_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	Issuer                            string   `json:"issuer"`
+	RequestURIParameterSupported      bool     `json:"request_uri_parameter_supported"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint,omitempty"`
+	TenantRegionScope                 string   `json:"tenant_region_scope"`
+	CloudInstanceName                 string   `json:"cloud_instance_name"`
+	CloudGraphHostName                string   `json:"cloud_graph_host_name"`
+	MsgraphHost                       string   `json:"msgraph_host"`
+}
+
+type UserRealmResponse struct {
+	Version           string `json:"ver"`
+	AccountType       string `json:"account_type"`
+	DomainName        string `json:"domain_name,omitempty"`
+	CloudInstanceName string `json:"cloud_instance_name"`
+	CloudAudienceURN  string `json:"cloud_audience_urn"`
+}
+
+// authorityAliases are the hosts MSAL may use interchangeably for fakeazure: the one the client
+// reached, the configured authority host, and any configured aliases
+func authorityAliases(r *http.Request) []string {
+	aliases := []string{r.Host}
+
+	hosts := append([]string{Config.AuthorityHost}, Config.AuthorityAliases...)
+	for _, host := range hosts {
+		host = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://"), "/")
+		if host == "" {
+			continue
+		}
+
+		known := false
+		for _, alias := range aliases {
+			known = known || strings.EqualFold(alias, host)
+		}
+		if !known {
+			aliases = append(aliases, host)
+		}
+	}
+
+	return aliases
+}
+
+// isMultiTenantAuthority says whether the tenant segment names a group of tenants rather than one tenant
+func isMultiTenantAuthority(tenantID string) bool {
+	switch strings.ToLower(tenantID) {
+	case "common", "organizations", "consumers":
+		return true
+	}
+
+	return false
+}
+
+// authorityBase is where the tenant endpoints live, keeping the /authority prefix the request came in on
+func authorityBase(r *http.Request) string {
+	if Config.AuthorityHost == "" && strings.HasPrefix(r.URL.Path, "/authority/") {
+		return authorityHost(r) + "/authority"
+	}
+
+	return authorityHost(r)
+}
+
+// InstanceDiscoveryGet answers MSAL's instance discovery, which validates the authority and
+// learns its aliases before any token request
+func InstanceDiscoveryGet(w http.ResponseWriter, r *http.Request) {
+	tenantID := "common"
+
+	if endpoint := r.URL.Query().Get("authorization_endpoint"); endpoint != "" {
+		parsed, err := url.Parse(endpoint)
+		segments := []string{}
+		if err == nil {
+			segments = strings.Split(strings.Trim(parsed.Path, "/"), "/")
+		}
+		// the authority may live under the /authority prefix, as fakeazure's own endpoints do
+		if len(segments) > 1 && segments[0] == "authority" {
+			segments = segments[1:]
+		}
+		if err != nil || parsed.Host == "" || len(segments) == 0 || segments[0] == "" {
+			AADInvalidInstance.Write(w)
+			return
+		}
+
+		tenantID = segments[0]
+	}
+
+	aliases := authorityAliases(r)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(InstanceDiscoveryResponse{
+		TenantDiscoveryEndpoint: authorityBase(r) + "/" + tenantID + "/v2.0/.well-known/openid-configuration",
+		APIVersion:              "1.1",
+		Metadata: []*InstanceMetadata{
+			{
+				PreferredNetwork: aliases[0],
+				PreferredCache:   aliases[0],
+				Aliases:          aliases,
+			},
+		},
+	})
+}
+
+// OpenIDConfigurationGet serves the tenant metadata document, in its v2.0 or v1 flavour
+func OpenIDConfigurationGet(w http.ResponseWriter, r *http.Request) {
+	tenantID := mux.Vars(r)["tenantId"]
+	base := authorityBase(r) + "/" + tenantID
+	v2 := strings.Contains(r.URL.Path, "/v2.0/")
+
+	// multi-tenant authorities leave the issuer as a template, as AAD does
+	issuerTenant := tenantID
+	if isMultiTenantAuthority(tenantID) {
+		issuerTenant = "{tenantid}"
+	}
+
+	configuration := OpenIDConfiguration{
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_post", "private_key_jwt", "client_secret_basic"},
+		ResponseModesSupported:            []string{"query", "fragment", "form_post"},
+		SubjectTypesSupported:             []string{"pairwise"},
+		IDTokenSigningAlgValuesSupported:  []string{"HS256"},
+		ResponseTypesSupported:            []string{"code", "id_token", "code id_token", "id_token token"},
+		ScopesSupported:                   []string{"openid", "profile", "email", "offline_access"},
+		RequestURIParameterSupported:      false,
+		TenantRegionScope:                 "NA",
+		CloudInstanceName:                 CloudFor(r).CloudInstanceName,
+		CloudGraphHostName:                "graph.windows.net",
+		MsgraphHost:                       "graph.microsoft.com",
+	}
+
+	if v2 {
+		configuration.TokenEndpoint = base + "/oauth2/v2.0/token"
+		configuration.AuthorizationEndpoint = base + "/oauth2/v2.0/authorize"
+		configuration.DeviceAuthorizationEndpoint = base + "/oauth2/v2.0/devicecode"
+		configuration.JwksURI = base + "/discovery/v2.0/keys"
+		configuration.Issuer = CloudFor(r).Issuer(issuerTenant, "2.0")
+	} else {
+		configuration.TokenEndpoint = base + "/oauth2/token"
+		configuration.AuthorizationEndpoint = base + "/oauth2/authorize"
+		configuration.JwksURI = base + "/discovery/keys"
+		configuration.Issuer = CloudFor(r).Issuer(issuerTenant, "1.0")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(configuration)
+}
+
+// SigningKeysGet publishes no keys: tokens are signed with a symmetric per-process secret,
+// so relying parties cannot verify them and must not try
+func SigningKeysGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []interface{}{},
+	})
+}
+
+// UserRealmGet tells MSAL whether a user's domain is managed by AAD. Domains of configured
+// test users are managed, anything else is unknown.
+func UserRealmGet(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	domain := ""
+	if at := strings.LastIndex(username, "@"); at >= 0 {
+		domain = strings.ToLower(username[at+1:])
+	}
+
+	response := UserRealmResponse{
+		Version:           "1.0",
+		AccountType:       "Unknown",
+		CloudInstanceName: CloudFor(r).CloudInstanceName,
+		CloudAudienceURN:  "urn:federation:MicrosoftOnline",
+	}
+
+	for _, user := range Config.Users {
+		if domain != "" && strings.HasSuffix(strings.ToLower(user.UPN), "@"+domain) {
+			response.AccountType = "Managed"
+			response.DomainName = domain
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestInstanceDiscoveryTenant(t *testing.T) {
+	withDefaultConfig(t)
+
+	tests := []struct {
+		path      string
+		authority string
+		want      string
+	}{
+		{"/common/discovery/instance", "http://fakeazure:8081/fake_tenant/oauth2/v2.0/authorize", "http://example.com/fake_tenant/v2.0/.well-known/openid-configuration"},
+		{"/authority/common/discovery/instance", "http://fakeazure:8081/authority/fake_tenant/oauth2/v2.0/authorize", "http://example.com/authority/fake_tenant/v2.0/.well-known/openid-configuration"},
+		{"/common/discovery/instance", "", "http://example.com/common/v2.0/.well-known/openid-configuration"},
+	}
+
+	for _, test := range tests {
+		target := test.path + "?api-version=1.1"
+		if test.authority != "" {
+			target += "&authorization_endpoint=" + url.QueryEscape(test.authority)
+		}
+
+		recorder := serve(http.MethodGet, target, "", nil)
+		expectStatus(t, recorder, http.StatusOK)
+
+		if endpoint := decodeBody(t, recorder)["tenant_discovery_endpoint"]; endpoint != test.want {
+			t.Errorf("discovery of %q answered %v, want %s", test.authority, endpoint, test.want)
+		}
+	}
+
+	recorder := serve(http.MethodGet, "/common/discovery/instance?authorization_endpoint="+url.QueryEscape("not a url"), "", nil)
+	expectStatus(t, recorder, http.StatusBadRequest)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// AzureError is the error body of Key Vault and the other Azure data planes
+type AzureError struct {
+	Error *AzureErrorDetail `json:"error"`
+}
+
+type AzureErrorDetail struct {
+	Code       string           `json:"code"`
+	Message    string           `json:"message"`
+	InnerError *AzureInnerError `json:"innererror,omitempty"`
+}
+
+// AzureInnerError narrows down the cause of an error. Key Vault only sends its code.
+type AzureInnerError struct {
+	Code string `json:"code"`
+}
+
+// KeyVaultError is an entry in the catalog of Key Vault errors. The message is a format
+// filled in by Write.
+type KeyVaultError struct {
+	Status    int
+	Code      string
+	InnerCode string
+	Message   string
+}
+
+// The Key Vault errors, with the codes, inner codes and wording Key Vault answers with
+var (
+	KeyVaultBadParameter = KeyVaultError{http.StatusBadRequest, "BadParameter", "", "%s"}
+
+	// the challenge header is set by the caller, see SetKeyVaultChallenge
+	KeyVaultUnauthorized = KeyVaultError{http.StatusUnauthorized, "Unauthorized", "", "%s"}
+
+	// appid, oid, iss, collection, permission, vault and location
+	KeyVaultForbiddenByPolicy = KeyVaultError{http.StatusForbidden, "Forbidden", "AccessDenied",
+		"The user, group or application 'appid=%s;oid=%s;iss=%s' does not have %s %s permission on key vault '%s;location=%s'. " +
+			"For help resolving this issue, please see https://go.microsoft.com/fwlink/?linkid=2125287"}
+
+	// appid, oid, iss, action, resource, vault and location
+	KeyVaultForbiddenByRbac = KeyVaultError{http.StatusForbidden, "Forbidden", "ForbiddenByRbac",
+		"Caller is not authorized to perform action on resource.\r\n" +
+			"If role assignments, deny assignments or role definitions were changed recently, please observe propagation time.\r\n" +
+			"Caller: appid=%s;oid=%s;iss=%s\r\n" +
+			"Action: '%s'\r\n" +
+			"Resource: '%s'\r\n" +
+			"Assignment: (not found)\r\n" +
+			"DenyAssignmentId: null\r\n" +
+			"DecisionReason: null \r\n" +
+			"Vault: %s;location=%s\r\n"}
+
+	KeyVaultSecretNotFound = KeyVaultError{http.StatusNotFound, "SecretNotFound", "",
+		"A secret with (name/id) %s was not found in this key vault. If you recently deleted this secret you may be able to recover it " +
+			"using the correct recovery command. For help resolving this issue, please see https://go.microsoft.com/fwlink/?linkid=2125182"}
+
+	KeyVaultKeyNotFound = KeyVaultError{http.StatusNotFound, "KeyNotFound", "",
+		"A key with (name/id) %s was not found in this key vault. If you recently deleted this key you may be able to recover it " +
+			"using the correct recovery command. For help resolving this issue, please see https://go.microsoft.com/fwlink/?linkid=2125182"}
+
+	KeyVaultCertificateNotFound = KeyVaultError{http.StatusNotFound, "CertificateNotFound", "",
+		"A certificate with (name/id) %s was not found in this key vault. If you recently deleted this certificate you may be able to recover it " +
+			"using the correct recovery command. For help resolving this issue, please see https://go.microsoft.com/fwlink/?linkid=2125182"}
+
+	// kind, name and kind again, e.g. Secret, demo, secret
+	KeyVaultConflict = KeyVaultError{http.StatusConflict, "Conflict", "ObjectIsDeletedButRecoverable",
+		"%s %s is currently in a deleted but recoverable state, and its name cannot be reused; " +
+			"in this state, the %s can only be recovered or purged."}
+
+	// the caller sets Retry-After
+	KeyVaultThrottled = KeyVaultError{http.StatusTooManyRequests, "Throttled", "VaultRequestTypeLimitReached",
+		"Request was not processed because too many requests were received. Reason: VaultRequestTypeLimitReached. Vault: %s"}
+
+	KeyVaultInternalServerError = KeyVaultError{http.StatusInternalServerError, "InternalServerError", "", "%s"}
+)
+
+// KeyVaultErrorFor is the error of a status Key Vault has no code of its own for, named after
+// the status text
+func KeyVaultErrorFor(status int) KeyVaultError {
+	code := strings.Map(func(c rune) rune {
+		if unicode.IsLetter(c) {
+			return c
+		}
+		return -1
+	}, http.StatusText(status))
+
+	return KeyVaultError{status, code, "", http.StatusText(status)}
+}
+
+// Write answers with the error, its message formatted with args
+func (e KeyVaultError) Write(w http.ResponseWriter, args ...interface{}) {
+	detail := &AzureErrorDetail{
+		Code:    e.Code,
+		Message: fmt.Sprintf(e.Message, args...),
+	}
+	if e.InnerCode != "" {
+		detail.InnerError = &AzureInnerError{Code: e.InnerCode}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(AzureError{detail})
+}
+
+// AADError is an entry in the catalog of Microsoft Entra ID (AAD) errors. The description is a
+// format filled in by Write, and prefixed with the AADSTS code.
+type AADError struct {
+	Status      int
+	Error       string
+	Code        int
+	Description string
+}
+
+// The AAD errors of the token, device code and discovery endpoints
+var (
+	AADMissingParameter = AADError{http.StatusBadRequest, "invalid_request", 900144,
+		"The request body must contain the following parameter: '%s'."}
+	AADInvalidClaims = AADError{http.StatusBadRequest, "invalid_request", 90014,
+		"The required field 'claims' is missing or is not a valid JSON object."}
+	AADMalformedToken = AADError{http.StatusBadRequest, "invalid_request", 50027,
+		"JWT token is invalid or malformed."}
+	AADUnsupportedGrantType = AADError{http.StatusBadRequest, "unsupported_grant_type", 70003,
+		"The app requested an unsupported grant type '%s'."}
+	AADInvalidClientCredentialScope = AADError{http.StatusBadRequest, "invalid_scope", 70011,
+		"The provided request must include a 'scope' input parameter. The provided value for the input parameter 'scope' is not valid. " +
+			"The scope %s is not valid. Client credential flows must have a single scope value with /.default suffixed to the resource identifier."}
+	AADMissingClientCredential = AADError{http.StatusUnauthorized, "invalid_client", 7000216,
+		"'client_assertion', 'client_secret' or 'request' is required for the '%s' grant type."}
+	AADTooManyClientCredentials = AADError{http.StatusBadRequest, "invalid_request", 7000216,
+		"Only one of 'client_assertion' or 'client_secret' may be presented for the '%s' grant type."}
+	AADInvalidClientSecret = AADError{http.StatusUnauthorized, "invalid_client", 7000215,
+		"Invalid client secret provided. Ensure the secret being sent in the request is the client secret value, " +
+			"not the client secret ID, for a secret added to app '%s'."}
+	AADNoTenantIdentified = AADError{http.StatusBadRequest, "invalid_request", 50059,
+		"No tenant-identifying information found in either the request or implied by any provided credentials."}
+	AADAccessBlocked = AADError{http.StatusForbidden, "access_denied", 53003,
+		"Access has been blocked by Conditional Access policies. The access policy does not allow token issuance."}
+
+	AADInvalidGrant = AADError{http.StatusBadRequest, "invalid_grant", 70000,
+		"Provided grant is invalid or malformed."}
+	AADMalformedGrant = AADError{http.StatusBadRequest, "invalid_grant", 9002313,
+		"Invalid request. Request is malformed or invalid."}
+	AADCodeRedeemed = AADError{http.StatusBadRequest, "invalid_grant", 54005,
+		"OAuth2 Authorization code was already redeemed, please retry with a new valid code or use an existing refresh token."}
+	AADGrantExpired = AADError{http.StatusBadRequest, "invalid_grant", 70008,
+		"The provided authorization code or refresh token has expired due to inactivity. " +
+			"Send a new interactive authorization request for this user and resource."}
+	AADCodeWrongClient = AADError{http.StatusBadRequest, "invalid_grant", 70002,
+		"The authorization code was issued to a different client or tenant."}
+	AADRedirectURIMismatch = AADError{http.StatusBadRequest, "invalid_grant", 50011,
+		"The redirect URI specified in the request does not match the redirect URI used to request the authorization code."}
+	AADCodeVerifierMismatch = AADError{http.StatusBadRequest, "invalid_grant", 501481,
+		"The Code_Verifier does not match the code_challenge supplied in the authorization request."}
+	AADGrantRevoked = AADError{http.StatusBadRequest, "invalid_grant", 50173,
+		"The provided grant has expired due to it being revoked, a fresh auth token is needed."}
+
+	AADAssertionNotUserToken = AADError{http.StatusBadRequest, "invalid_grant", 50013,
+		"Assertion is not a user token, app-only tokens cannot be exchanged on behalf of a user."}
+	AADAssertionExpired = AADError{http.StatusBadRequest, "invalid_grant", 500133,
+		"Assertion is not within its valid time range."}
+	AADAssertionAudienceMismatch = AADError{http.StatusBadRequest, "invalid_grant", 50013,
+		"Assertion audience does not match the Client app presenting the assertion. The audience in the assertion was '%s' and the expected audience is '%s'."}
+	AADAssertionInvalidIssuer = AADError{http.StatusBadRequest, "invalid_grant", 50013,
+		"Assertion contains an invalid issuer for tenant '%s'."}
+
+	AADDeviceCodeExpired = AADError{http.StatusBadRequest, "expired_token", 70020,
+		"The provided value for the input parameter 'device_code' is not valid. This device code has expired."}
+	AADAuthorizationDeclined = AADError{http.StatusBadRequest, "authorization_declined", 70011,
+		"The end-user denied the authorization request."}
+	AADSlowDown = AADError{http.StatusBadRequest, "slow_down", 70016,
+		"The client is polling too frequently. Increase the polling interval."}
+	AADAuthorizationPending = AADError{http.StatusBadRequest, "authorization_pending", 70016,
+		"OAuth 2.0 device flow error. Authorization is pending. Continue polling."}
+
+	AADInvalidInstance = AADError{http.StatusBadRequest, "invalid_instance", 50049,
+		"Unknown or invalid instance."}
+
+	// the caller sets Retry-After
+	AADRequestLoop = AADError{http.StatusTooManyRequests, "temporarily_unavailable", 50196,
+		"The server terminated an operation because it encountered a client request loop. Please contact your app vendor."}
+	AADServerError = AADError{http.StatusInternalServerError, "server_error", 50000,
+		"There was an error issuing a token or an issue with our sign-in service."}
+	AADTransientError = AADError{http.StatusServiceUnavailable, "temporarily_unavailable", 90033,
+		"A transient error has occurred. Please try again."}
+)
+
+// Write answers with the error, its description formatted with args
+func (e AADError) Write(w http.ResponseWriter, args ...interface{}) {
+	writeOAuthError(w, e.Status, e.Error, e.Code, fmt.Sprintf(e.Description, args...))
+}
+
+// ManagedIdentityError is an entry in the catalog of managed identity errors. The description is a
+// format filled in by Write or WriteAppService.
+type ManagedIdentityError struct {
+	Status      int
+	Error       string
+	Description string
+}
+
+// The errors of IMDS, Arc and App Service. App Service only sends the description, as its message.
+var (
+	ManagedIdentityMissingMetadata = ManagedIdentityError{http.StatusBadRequest, "invalid_request",
+		"Required metadata header not specified"}
+	ManagedIdentityForwarded = ManagedIdentityError{http.StatusBadRequest, "invalid_request",
+		"Request contains X-Forwarded-For header"}
+	ManagedIdentityMissingAPIVersion = ManagedIdentityError{http.StatusBadRequest, "invalid_request",
+		"Required query variable 'api-version' is missing"}
+	ManagedIdentityMissingResource = ManagedIdentityError{http.StatusBadRequest, "invalid_request",
+		"Required audience parameter not specified"}
+
+	// the reason SelectManagedIdentity gives
+	ManagedIdentityNotSelected = ManagedIdentityError{http.StatusBadRequest, "invalid_request", "%s"}
+
+	ManagedIdentityNotFound = ManagedIdentityError{http.StatusBadRequest, "invalid_request",
+		"Identity not found"}
+	ManagedIdentityUserAssignedOnArc = ManagedIdentityError{http.StatusBadRequest, "invalid_request",
+		"User assigned identities are not supported on Azure Arc"}
+	ManagedIdentityChallengeRequired = ManagedIdentityError{http.StatusUnauthorized, "unauthorized_client",
+		"Authorization header with the challenge key file contents is required"}
+	ManagedIdentityChallengeMismatch = ManagedIdentityError{http.StatusUnauthorized, "unauthorized_client",
+		"The challenge key does not match any issued key file"}
+	ManagedIdentityThrottled = ManagedIdentityError{http.StatusTooManyRequests, "too_many_requests",
+		"Too many requests to the identity endpoint. Please retry later."}
+	ManagedIdentityUnexpectedError = ManagedIdentityError{http.StatusInternalServerError, "unknown_error",
+		"An unexpected error occured while fetching the AAD Token."}
+	ManagedIdentityInternalError = ManagedIdentityError{http.StatusInternalServerError, "unknown_error", "%s"}
+
+	AppServiceMissingIdentityHeader = ManagedIdentityError{http.StatusBadRequest, "invalid_request",
+		"Required header X-IDENTITY-HEADER is missing"}
+	AppServiceWrongIdentityHeader = ManagedIdentityError{http.StatusUnauthorized, "unauthorized_client",
+		"X-IDENTITY-HEADER does not match the IDENTITY_HEADER of this host"}
+	AppServiceUnsupportedAPIVersion = ManagedIdentityError{http.StatusBadRequest, "invalid_request",
+		"Only api-version 2019-08-01 is supported"}
+	AppServiceMissingResource = ManagedIdentityError{http.StatusBadRequest, "invalid_request",
+		"Required query parameter resource is missing"}
+)
+
+// ManagedIdentityErrorFor is the error the managed identity endpoints give for a
+// ?withcodemanagedidentity= status
+func ManagedIdentityErrorFor(status int) ManagedIdentityError {
+	var e ManagedIdentityError
+	switch {
+	case status == http.StatusBadRequest:
+		e = ManagedIdentityNotFound
+	case status == http.StatusTooManyRequests:
+		e = ManagedIdentityThrottled
+	case status >= 500:
+		e = ManagedIdentityUnexpectedError
+	default:
+		e = ManagedIdentityError{status, "invalid_request", http.StatusText(status)}
+	}
+
+	e.Status = status
+	return e
+}
+
+// Write answers with the error in the shape of IMDS and Arc, its description formatted with args
+func (e ManagedIdentityError) Write(w http.ResponseWriter, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(ManagedIdentityErrorResponse{
+		Error:            e.Error,
+		ErrorDescription: fmt.Sprintf(e.Description, args...),
+	})
+}
+
+// WriteAppService answers with the error in the App Service envelope, its description formatted
+// with args
+func (e ManagedIdentityError) WriteAppService(w http.ResponseWriter, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(AppServiceErrorResponse{
+		StatusCode:    e.Status,
+		Message:       fmt.Sprintf(e.Description, args...),
+		CorrelationID: RandStringRunes(32),
+	})
+}
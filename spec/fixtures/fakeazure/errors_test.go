@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestKeyVaultErrorForUncataloguedStatus(t *testing.T) {
+	withDefaultConfig(t)
+
+	token, _ := IssueAppToken(DefaultCloud(), "fake_tenant", "fake_client", "https://vault.azure.net", "1.0", Now().Unix(), 3600)
+	recorder := serve(http.MethodGet, "/keyvault/jack-vault/secrets/demo?api-version=7.4&withcode=503", "", map[string]string{"Authorization": "Bearer " + token})
+	expectStatus(t, recorder, http.StatusServiceUnavailable)
+
+	keyVaultError, _ := decodeBody(t, recorder)["error"].(map[string]interface{})
+	if keyVaultError["code"] != "ServiceUnavailable" || keyVaultError["message"] != "Service Unavailable" || keyVaultError["innererror"] != nil {
+		t.Fatalf("status without a Key Vault code was not named after its status text: %v", keyVaultError)
+	}
+}
+
+func TestManagedIdentityErrorShapes(t *testing.T) {
+	withDefaultConfig(t)
+
+	// IMDS and Arc answer {"error", "error_description"}
+	recorder := serve(http.MethodGet, "/metadata/identity/oauth2/token?api-version=2018-02-01", "", map[string]string{"Metadata": "true"})
+	expectStatus(t, recorder, http.StatusBadRequest)
+	if body := decodeBody(t, recorder); body["error"] != ManagedIdentityMissingResource.Error || body["error_description"] != ManagedIdentityMissingResource.Description {
+		t.Fatalf("IMDS error is not the catalog entry: %v", body)
+	}
+
+	recorder = serve(http.MethodGet, "/arc/metadata/identity/oauth2/token?api-version=2020-06-01&resource=https://vault.azure.net&client_id=fake_client", "", map[string]string{"Metadata": "true"})
+	expectStatus(t, recorder, http.StatusBadRequest)
+	if body := decodeBody(t, recorder); body["error_description"] != ManagedIdentityUserAssignedOnArc.Description {
+		t.Fatalf("Arc error is not the catalog entry: %v", body)
+	}
+
+	// App Service sends the description as the message of its envelope
+	recorder = serve(http.MethodGet, "/MSI/token/?api-version=2017-09-01&resource=https://vault.azure.net", "", map[string]string{"X-IDENTITY-HEADER": "fake_identity_header"})
+	expectStatus(t, recorder, http.StatusBadRequest)
+	if body := decodeBody(t, recorder); body["statusCode"] != float64(http.StatusBadRequest) || body["message"] != AppServiceUnsupportedAPIVersion.Description {
+		t.Fatalf("App Service error is not the catalog entry: %v", body)
+	}
+
+	tests := []struct {
+		status int
+		error  string
+	}{
+		{http.StatusBadRequest, "invalid_request"},
+		{http.StatusForbidden, "invalid_request"},
+		{http.StatusTooManyRequests, "too_many_requests"},
+		{http.StatusBadGateway, "unknown_error"},
+	}
+
+	for _, test := range tests {
+		if e := ManagedIdentityErrorFor(test.status); e.Status != test.status || e.Error != test.error {
+			t.Errorf("status %d maps to %+v, want error %s", test.status, e, test.error)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// FaultRule replaces the answer to matching requests, for a number of calls or a share of them.
+// Requests that no rule fires for fall through to the normal handlers.
+type FaultRule struct {
+	ID string `json:"id"`
+
+	// what to match: empty fields match anything, `path` may use `*` for any characters
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+
+	// what to answer: `body` is written as is when it is a string, and as JSON otherwise
+	Status          int               `json:"status"`
+	ResponseHeaders map[string]string `json:"response_headers"`
+	Body            interface{}       `json:"body"`
+
+	// how to answer: after a delay, and in one of the slow modes of latency.go or the broken ones of chaos.go
+	Delay          *Delay `json:"delay"`
+	Mode           string `json:"mode"`
+	DripBytes      int    `json:"drip_bytes"`
+	DripIntervalMs int    `json:"drip_interval_ms"`
+
+	// when to fire: `times` 0 means every matching call, `percentage` 0 means all of them
+	Times      int     `json:"times"`
+	Percentage float64 `json:"percentage"`
+	Fired      int     `json:"fired"`
+}
+
+// Matches tells whether a request is covered by the rule, regardless of how often it has fired
+func (rule *FaultRule) Matches(r *http.Request) bool {
+	if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+		return false
+	}
+
+	// paths use the same glob as role actions
+	if rule.Path != "" && !matchAction(rule.Path, r.URL.Path) {
+		return false
+	}
+
+	for name, value := range rule.Headers {
+		if !matchAction(value, r.Header.Get(name)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// answers tells whether the rule writes its own response. A rule that only slows requests down
+// lets the normal handler answer.
+func (rule *FaultRule) answers() bool {
+	return rule.Status != 0 || rule.Body != nil || isChaosMode(rule.Mode) || (rule.Delay == nil && rule.Mode == "")
+}
+
+func (rule *FaultRule) exhausted() bool {
+	return rule.Times > 0 && rule.Fired >= rule.Times
+}
+
+// FireFaultRule returns a copy of the first rule that fires for the request, counting the call,
+// or nil when the request should be handled normally
+func FireFaultRule(r *http.Request) *FaultRule {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	for _, rule := range Config.FaultRules {
+		if rule.exhausted() || !rule.Matches(r) {
+			continue
+		}
+
+		if rule.Percentage > 0 && rand.Float64()*100 >= rule.Percentage {
+			continue
+		}
+
+		rule.Fired++
+		fired := *rule
+
+		return &fired
+	}
+
+	return nil
+}
+
+func writeFault(w http.ResponseWriter, rule *FaultRule) {
+	status := rule.Status
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	for name, value := range rule.ResponseHeaders {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(status)
+
+	switch body := rule.Body.(type) {
+	case nil:
+	case string:
+		w.Write([]byte(body))
+	default:
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+// InjectFaults answers with the fault rules before the router gets a chance to. The admin API
+// is never faulted, so rules can always be removed again.
+func InjectFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rule := FireFaultRule(r)
+		if rule == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w, ok := slowDown(w, r, rule)
+		if !ok {
+			return
+		}
+
+		if isChaosMode(rule.Mode) {
+			writeChaos(w, rule)
+		} else if rule.answers() {
+			writeFault(w, rule)
+		} else {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func AdminFaultsGet(w http.ResponseWriter, r *http.Request) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"value": Config.FaultRules,
+	})
+}
+
+// AdminFaultPut creates or replaces the fault rule named in the path. Replacing a rule resets its count.
+func AdminFaultPut(w http.ResponseWriter, r *http.Request) {
+	rule := &FaultRule{}
+	if err := json.NewDecoder(r.Body).Decode(rule); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "could not parse fault rule: "+err.Error())
+		return
+	}
+	rule.ID = mux.Vars(r)["faultId"]
+	rule.Fired = 0
+
+	if rule.Percentage < 0 || rule.Percentage > 100 {
+		writeAdminError(w, http.StatusBadRequest, "percentage must be between 0 and 100")
+		return
+	}
+
+	if rule.Times < 0 {
+		writeAdminError(w, http.StatusBadRequest, "times must not be negative")
+		return
+	}
+
+	if err := rule.validateModes(); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	replaced := false
+	for i, existing := range Config.FaultRules {
+		if existing.ID == rule.ID {
+			Config.FaultRules[i] = rule
+			replaced = true
+		}
+	}
+	if !replaced {
+		Config.FaultRules = append(Config.FaultRules, rule)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rule)
+}
+
+func AdminFaultDelete(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["faultId"]
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	for i, existing := range Config.FaultRules {
+		if existing.ID == id {
+			Config.FaultRules = append(Config.FaultRules[:i], Config.FaultRules[i+1:]...)
+
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	writeAdminError(w, http.StatusNotFound, "fault rule not found")
+}
+
+// AdminFaultsDelete removes every fault rule
+func AdminFaultsDelete(w http.ResponseWriter, r *http.Request) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	Config.FaultRules = nil
+
+	w.WriteHeader(http.StatusNoContent)
+}
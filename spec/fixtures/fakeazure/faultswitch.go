@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+)
+
+// FaultSwitchHeader carries the ?withcode= style switches for clients that build their own URLs,
+// in query string syntax such as `withcode=500&withexpiry=5`
+const FaultSwitchHeader = "X-Fakeazure-Fault"
+
+type ClientFaultRequest struct {
+	Fault string `json:"fault"`
+}
+
+// FaultSwitch reads one of the ?withcode= style switches: from the query string if given there,
+// then from the x-fakeazure-fault header, then from the switches set for the calling client ID
+func FaultSwitch(r *http.Request, name string) string {
+	if value := r.URL.Query().Get(name); value != "" {
+		return value
+	}
+
+	// a malformed header still yields the switches parsed before the error
+	switches, _ := url.ParseQuery(r.Header.Get(FaultSwitchHeader))
+	if value := switches.Get(name); value != "" {
+		return value
+	}
+
+	clientID := faultClientID(r)
+	if clientID == "" {
+		return ""
+	}
+
+	configLock.Lock()
+	fault, ok := Config.ClientFaults[clientID]
+	configLock.Unlock()
+	if !ok {
+		return ""
+	}
+
+	switches, _ = url.ParseQuery(fault)
+
+	return switches.Get(name)
+}
+
+// faultClientID is the client ID a request is made as: the `client_id` in its query string or form,
+// or the application its bearer token was issued to
+func faultClientID(r *http.Request) string {
+	if clientID := r.URL.Query().Get("client_id"); clientID != "" {
+		return clientID
+	}
+
+	// only form bodies are read, and ParseForm leaves them readable through r.PostForm
+	if err := r.ParseForm(); err == nil {
+		if clientID := r.PostForm.Get("client_id"); clientID != "" {
+			return clientID
+		}
+	}
+
+	if issued, ok := Tokens.Lookup(r.Header.Get("Authorization")); ok {
+		return issued.ClientID
+	}
+
+	return ""
+}
+
+func AdminClientFaultsGet(w http.ResponseWriter, r *http.Request) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"value": Config.ClientFaults,
+	})
+}
+
+// AdminClientFaultPut sets the switches applied to every request made as the client ID in the path
+func AdminClientFaultPut(w http.ResponseWriter, r *http.Request) {
+	var request ClientFaultRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "could not parse client fault: "+err.Error())
+		return
+	}
+
+	if _, err := url.ParseQuery(request.Fault); err != nil || request.Fault == "" {
+		writeAdminError(w, http.StatusBadRequest, "fault must be switches in query string syntax, such as withcode=500")
+		return
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	if Config.ClientFaults == nil {
+		Config.ClientFaults = map[string]string{}
+	}
+	Config.ClientFaults[mux.Vars(r)["clientId"]] = request.Fault
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(request)
+}
+
+func AdminClientFaultDelete(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientId"]
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	if _, ok := Config.ClientFaults[clientID]; !ok {
+		writeAdminError(w, http.StatusNotFound, "client fault not found")
+		return
+	}
+	delete(Config.ClientFaults, clientID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
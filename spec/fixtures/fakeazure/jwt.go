@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Claims is the decoded payload of a token minted by fakeazure
+type Claims map[string]interface{}
+
+// signingKey is generated once per process, so tokens never survive a restart
+var signingKey []byte = newSigningKey()
+
+func newSigningKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+
+	return key
+}
+
+func (c Claims) String(name string) string {
+	if value, ok := c[name].(string); ok {
+		return value
+	}
+
+	return ""
+}
+
+func (c Claims) Int64(name string) int64 {
+	switch value := c[name].(type) {
+	case float64:
+		return int64(value)
+	case int64:
+		return value
+	case int:
+		return int64(value)
+	}
+
+	return 0
+}
+
+// MintToken signs the claims into a compact JWT (HS256)
+func MintToken(claims Claims) string {
+	header, _ := json.Marshal(map[string]string{
+		"alg": "HS256",
+		"typ": "JWT",
+		"kid": "fakeazure",
+	})
+	payload, _ := json.Marshal(claims)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	return signingInput + "." + signToken(signingInput)
+}
+
+// ParseToken verifies a token minted by this process and returns its claims
+func ParseToken(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a compact JWT")
+	}
+
+	if !hmac.Equal([]byte(signToken(parts[0]+"."+parts[1])), []byte(parts[2])) {
+		return nil, errors.New("token signature is invalid")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	claims := Claims{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func signToken(signingInput string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(signingInput))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
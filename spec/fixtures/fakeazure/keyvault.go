@@ -3,10 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
-	"time"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -27,83 +26,62 @@ type KeyVaultGetSecretResponse struct {
 	Value      string              `json:"value"`
 }
 
-func KeyVaultGetKeyVersion(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	keyVersion := vars["keyVersion"]
-
-	KeyVaultGetKey(w, r, keyVersion)
+// SetKeyVaultChallenge adds the challenge that Azure SDKs use to discover the tenant and resource of a vault
+func SetKeyVaultChallenge(w http.ResponseWriter, r *http.Request, vaultName string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer authorization="%s/%s", resource="%s"`, authorityHost(r), FindVault(vaultName).TenantFor(), CloudFor(r).KeyVaultAudience))
 }
 
-func KeyVaultGetKeyDefault(w http.ResponseWriter, r *http.Request) {
-	KeyVaultGetKey(w, r, "9bdcdbefc49446dd9a2a9b3f55e10340")
-}
-
-func KeyVaultGetKey(w http.ResponseWriter, r *http.Request, keyVersion string) {
-	vars := mux.Vars(r)
-	keyName, ok := vars["keyName"]
-	if !ok {
-		log.Println("Not keyName specified")
-		// do an error
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"generic error": "error",
-		})
+// authorityHost is fakeazure itself as reached by the client, unless an authority is configured.
+// The configured authority stands for the cloud of the main listener, and any other cloud points
+// at its own.
+func authorityHost(r *http.Request) string {
+	if Config.AuthorityHost == "" {
+		return "http://" + r.Host
 	}
-	vaultName, ok := vars["vaultName"]
-	if !ok {
-		log.Println("Not vaultName specified")
-		// do an error
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"generic error": "error",
-		})
+
+	if cloud := CloudFor(r); cloud != DefaultCloud() {
+		return cloud.AuthorityHost
 	}
 
-	// Check if we want a fake error
-	var withCode int = 0
-	var err error
+	return strings.TrimSuffix(Config.AuthorityHost, "/")
+}
 
-	withCodeRaw := r.URL.Query().Get("withcode")
-	if withCodeRaw != "" {
-		withCode, err = strconv.Atoi(withCodeRaw)
+func unauthorizedMessage(authHeader string) string {
+	if authHeader == "" {
+		return "AKV10000: Request is missing a Bearer or PoP token."
+	}
 
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"error": map[string]string{
-					"code":    "internal server error",
-					"message": "could not parse 'withcode' as an integer when retrieving key",
-				},
-			})
+	return "[BearerReadAccessTokenFailed] Error validating token: 'S2S12005'."
+}
 
-			return
-		}
+// keyVaultFakeResponse applies the ?withcode= switch shared by the Key Vault handlers, answering with
+// the catalog error for the status. It returns true when a fake error has been written.
+func keyVaultFakeResponse(w http.ResponseWriter, r *http.Request, vaultName string, collection string, objectName string) bool {
+	withCodeRaw := FaultSwitch(r, "withcode")
+	if withCodeRaw == "" {
+		return false
 	}
 
-	switch withCode {
-	case 500:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]string{
-				"code":    "internal server error",
-				"message": "error retrieving key",
-			},
-		})
+	withCode, err := strconv.Atoi(withCodeRaw)
+	if err != nil {
+		KeyVaultInternalServerError.Write(w, "could not parse 'withcode' as an integer")
+		return true
+	}
 
-		return
+	kind := strings.TrimSuffix(collection, "s")
+
+	switch withCode {
+	case 0, 200:
+		return false
 
 	case 501:
+		// an error page from something in front of Key Vault
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("<html><body>This is some HTML error that can happen</body></html>"))
 
-		return
-
 	case 502:
+		// valid JSON, but not in the shape of an Azure error
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -112,272 +90,149 @@ func KeyVaultGetKey(w http.ResponseWriter, r *http.Request, keyVersion string) {
 			},
 		})
 
-		return
+	case 400:
+		KeyVaultBadParameter.Write(w, fmt.Sprintf("The request URI contains an invalid name: %s", objectName))
 
 	case 401:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(401)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]string{
-				"code":    "unauthorized",
-				"message": "invalid authentication credentials when retrieving key",
-			},
-		})
+		SetKeyVaultChallenge(w, r, vaultName)
+		KeyVaultUnauthorized.Write(w, unauthorizedMessage(""))
 
-		return
+	case 403:
+		claims, _ := ParseToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		vault := FindVault(vaultName)
+		KeyVaultForbiddenByPolicy.Write(w,
+			claims.String("appid"), claims.String("oid"), claims.String("iss"), collection, "get", vault.Name, vault.Location)
 
 	case 404:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(404)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]string{
-				"code":    "KeyNotFound",
-				"message": fmt.Sprintf("A key with (name/id) %s was not found in this key vault. If you recently deleted this key you may be able to recover it using the correct recovery command. For help resolving this issue, please see redacted", keyName),
-			},
-		})
+		switch collection {
+		case "keys":
+			KeyVaultKeyNotFound.Write(w, objectName)
+		case "certificates":
+			KeyVaultCertificateNotFound.Write(w, objectName)
+		default:
+			KeyVaultSecretNotFound.Write(w, objectName)
+		}
 
-		return
+	case 409:
+		KeyVaultConflict.Write(w, strings.ToUpper(kind[:1])+kind[1:], objectName, kind)
 
-	case 403:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(403)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]string{
-				"code":    "forbidden",
-				"message": "not allowed on this specific tenant perhaps when retrieving key",
-			},
-		})
+	case 429:
+		w.Header().Set("Retry-After", strconv.Itoa(throttlingWindow))
+		KeyVaultThrottled.Write(w, vaultName)
 
-		return
+	case 500:
+		KeyVaultInternalServerError.Write(w, fmt.Sprintf("An unexpected error occurred while retrieving %s %s.", kind, objectName))
 
 	default:
-		if withCode == 0 || withCode == 200 {
-			authHeader := r.Header.Get("Authorization")
-
-			//if contains(Tokens, authHeader) {
-			if expiresAt, ok := Tokens[authHeader]; ok {
-				if time.Now().Unix() > expiresAt {
-					// Unauthorized
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusUnauthorized)
-					json.NewEncoder(w).Encode(AzureError{
-						&AzureErrorDetail{
-							Code:    "Unauthorized",
-							Message: "[TokenExpired] Error validating token: 'S2S12086'.",
-						},
-					})
-				} else {
-					// Good
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusOK)
-
-					keyObject := &AzureKey{}
-					json.Unmarshal([]byte(`{    "attributes": {        "created": 1673029410,        "enabled": true,        "recoverableDays": 7,        "recoveryLevel": "CustomizedRecoverable+Purgeable",        "updated": 1673029410    },    "key": {        "e": "AQAB",        "key_ops": [            "sign",            "verify",            "wrapKey",            "unwrapKey",            "encrypt",            "decrypt"        ],        "kid": "https://localhost",        "kty": "RSA",        "n": "ruqZAvsEEnCJqpNmVZbi...=="    },    "tags": {}}`), keyObject)
-
-					keyObject.Key.Kid = fmt.Sprintf("http://fakeazure:8081/keyvault/%s/keys/%s/%s", vaultName, keyName, keyVersion)
-
-					json.NewEncoder(w).Encode(keyObject)
-				}
-			} else {
-				// Unauthorized
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusUnauthorized)
-				json.NewEncoder(w).Encode(AzureError{
-					&AzureErrorDetail{
-						Code:    "Unauthorized",
-						Message: "[BearerReadAccessTokenFailed] Error validating token: 'S2S12005'.",
-					},
-				})
-			}
-
-		} else {
-			// Nonspecific fake error code
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(withCode)
-			json.NewEncoder(w).Encode(map[string]string{
-				"nonspecific error": "error retrieving secret",
-			})
-
-		}
+		KeyVaultErrorFor(withCode).Write(w)
 	}
+
+	return true
 }
 
-func KeyVaultGetCertificateVersion(w http.ResponseWriter, r *http.Request) {
+func KeyVaultGetKeyVersion(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	certificateVersion := vars["certificateVersion"]
+	keyVersion := vars["keyVersion"]
 
-	KeyVaultGetCertificate(w, r, certificateVersion)
+	KeyVaultGetKey(w, r, keyVersion)
 }
 
-func KeyVaultGetCertificateDefault(w http.ResponseWriter, r *http.Request) {
-	KeyVaultGetCertificate(w, r, "9bdcdbefc49446dd9a2a9b3f55e10340")
+func KeyVaultGetKeyDefault(w http.ResponseWriter, r *http.Request) {
+	KeyVaultGetKey(w, r, "9bdcdbefc49446dd9a2a9b3f55e10340")
 }
 
-func KeyVaultGetCertificate(w http.ResponseWriter, r *http.Request, certificateVersion string) {
+func KeyVaultGetKey(w http.ResponseWriter, r *http.Request, keyVersion string) {
 	vars := mux.Vars(r)
-	certificateName, ok := vars["certificateName"]
-	if !ok {
-		log.Println("Not certificateName specified")
-		// do an error
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"generic error": "error",
-		})
-	}
-	vaultName, ok := vars["vaultName"]
-	if !ok {
-		log.Println("Not vaultName specified")
-		// do an error
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"generic error": "error",
-		})
+	keyName := vars["keyName"]
+	vaultName := vars["vaultName"]
+
+	if keyVaultFakeResponse(w, r, vaultName, "keys", keyName) {
+		return
 	}
 
-	// Check if we want a fake error
-	var withCode int = 0
-	var err error
+	authHeader := r.Header.Get("Authorization")
+
+	if issued, ok := Tokens.Lookup(authHeader); ok {
+		if Now().Unix() > issued.ExpiresAt {
+			// Unauthorized
+			SetKeyVaultChallenge(w, r, vaultName)
+			KeyVaultUnauthorized.Write(w, "[TokenExpired] Error validating token: 'S2S12086'.")
+		} else if issued.Revoked() {
+			writeKeyVaultTokenRevoked(w, r, vaultName, issued.RevokedAt)
+		} else if AuthorizeKeyVault(w, r, vaultName, "keys", keyName, KeyReadAction) {
+			// Good
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
 
-	withCodeRaw := r.URL.Query().Get("withcode")
-	if withCodeRaw != "" {
-		withCode, err = strconv.Atoi(withCodeRaw)
+			keyObject := &AzureKey{}
+			json.Unmarshal([]byte(`{    "attributes": {        "created": 1673029410,        "enabled": true,        "recoverableDays": 7,        "recoveryLevel": "CustomizedRecoverable+Purgeable",        "updated": 1673029410    },    "key": {        "e": "AQAB",        "key_ops": [            "sign",            "verify",            "wrapKey",            "unwrapKey",            "encrypt",            "decrypt"        ],        "kid": "https://localhost",        "kty": "RSA",        "n": "ruqZAvsEEnCJqpNmVZbi...=="    },    "tags": {}}`), keyObject)
 
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"error": map[string]string{
-					"code":    "internal server error",
-					"message": "could not parse 'withcode' as an integer when retrieving secret",
-				},
-			})
+			keyObject.Key.Kid = fmt.Sprintf("%s/keys/%s/%s", VaultBaseURL(r, vaultName), keyName, keyVersion)
+			keyObject.Attributes.Created = int(Config.FixtureEpoch)
+			keyObject.Attributes.Updated = int(Config.FixtureEpoch)
 
-			return
+			json.NewEncoder(w).Encode(keyObject)
 		}
+	} else {
+		// Unauthorized
+		SetKeyVaultChallenge(w, r, vaultName)
+		KeyVaultUnauthorized.Write(w, unauthorizedMessage(authHeader))
 	}
+}
 
-	switch withCode {
-	case 500:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]string{
-				"code":    "internal server error",
-				"message": "error retrieving secret",
-			},
-		})
-
-		return
-
-	case 501:
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("<html><body>This is some HTML error that can happen</body></html>"))
-
-		return
-
-	case 502:
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"fault": map[string]string{
-				"msg": "good json syntax but badly formatted error message",
-			},
-		})
-
-		return
-
-	case 401:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(401)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]string{
-				"code":    "unauthorized",
-				"message": "invalid authentication credentials when retrieving certificate",
-			},
-		})
-
-		return
+func KeyVaultGetCertificateVersion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	certificateVersion := vars["certificateVersion"]
 
-	case 404:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(404)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]string{
-				"code":    "not_found",
-				"message": fmt.Sprintf("certificate %s not found in this keyvault", certificateName),
-			},
-		})
+	KeyVaultGetCertificate(w, r, certificateVersion)
+}
 
-		return
+func KeyVaultGetCertificateDefault(w http.ResponseWriter, r *http.Request) {
+	KeyVaultGetCertificate(w, r, "9bdcdbefc49446dd9a2a9b3f55e10340")
+}
 
-	case 403:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(403)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]string{
-				"code":    "forbidden",
-				"message": "not allowed on this specific tenant perhaps when retrieving secret",
-			},
-		})
+func KeyVaultGetCertificate(w http.ResponseWriter, r *http.Request, certificateVersion string) {
+	vars := mux.Vars(r)
+	certificateName := vars["certificateName"]
+	vaultName := vars["vaultName"]
 
+	if keyVaultFakeResponse(w, r, vaultName, "certificates", certificateName) {
 		return
+	}
 
-	default:
-		if withCode == 0 || withCode == 200 {
-			authHeader := r.Header.Get("Authorization")
-
-			//if contains(Tokens, authHeader) {
-			if expiresAt, ok := Tokens[authHeader]; ok {
-				if time.Now().Unix() > expiresAt {
-					// Unauthorized
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusUnauthorized)
-					json.NewEncoder(w).Encode(AzureError{
-						&AzureErrorDetail{
-							Code:    "Unauthorized",
-							Message: "[TokenExpired] Error validating token: 'S2S12086'.",
-						},
-					})
-				} else {
-					// Good
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusOK)
-
-					certObject := &AzureCertificate{}
-					json.Unmarshal([]byte(`{    "attributes": {        "created": 1673029993,        "enabled": true,        "exp": 1704565993,        "nbf": 1673029393,        "recoverableDays": 7,        "recoveryLevel": "CustomizedRecoverable+Purgeable",        "updated": 1673029993    },    "cer": "MIIDPDCC...==",    "id": "https://localhost",    "kid": "https://localhost",    "pending": {        "id": "https://localhost"    },    "policy": {        "attributes": {            "created": 1673029989,            "enabled": true,            "updated": 1673029989        },        "id": "https://localhost",        "issuer": {            "name": "Self"        },        "key_props": {            "exportable": true,            "key_size": 2048,            "kty": "RSA",            "reuse_key": false        },        "lifetime_actions": [            {                "action": {                    "action_type": "AutoRenew"                },                "trigger": {                    "lifetime_percentage": 80                }            }        ],        "secret_props": {            "contentType": "application/x-pem-file"        },        "x509_props": {            "basic_constraints": {                "ca": false            },            "ekus": [                "1.3.6.1.5.5.7.3.1",                "1.3.6.1.5.5.7.3.2"            ],            "key_usage": [                "digitalSignature",                "keyEncipherment"            ],            "sans": {                "dns_names": []            },            "subject": "CN=test-certificate",            "validity_months": 12        }    },    "sid": "https://localhost",    "tags": {},    "x5t": "wOSk8759bvVk2tJc32vnVASBRLk"}`), certObject)
-
-					certObject.ID = fmt.Sprintf("http://fakeazure:8081/keyvault/%s/certificates/%s/%s", vaultName, certificateName, certificateVersion)
-					certObject.Kid = fmt.Sprintf("http://fakeazure:8081/keyvault/%s/keys/%s/%s", vaultName, certificateName, certificateVersion)
-					certObject.Sid = fmt.Sprintf("http://fakeazure:8081/keyvault/%s/certificates/%s/%s", vaultName, certificateName, certificateVersion)
-					certObject.Policy.ID = fmt.Sprintf("http://fakeazure:8081/keyvault/%s/certificates/%s/policy", vaultName, certificateName)
-					certObject.Pending.ID = fmt.Sprintf("http://fakeazure:8081/keyvault/%s/certificates/%s/pending", vaultName, certificateName)
-
-					json.NewEncoder(w).Encode(certObject)
-				}
-			} else {
-				// Unauthorized
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusUnauthorized)
-				json.NewEncoder(w).Encode(AzureError{
-					&AzureErrorDetail{
-						Code:    "Unauthorized",
-						Message: "[BearerReadAccessTokenFailed] Error validating token: 'S2S12005'.",
-					},
-				})
-			}
-
-		} else {
-			// Nonspecific fake error code
+	authHeader := r.Header.Get("Authorization")
+
+	if issued, ok := Tokens.Lookup(authHeader); ok {
+		if Now().Unix() > issued.ExpiresAt {
+			// Unauthorized
+			SetKeyVaultChallenge(w, r, vaultName)
+			KeyVaultUnauthorized.Write(w, "[TokenExpired] Error validating token: 'S2S12086'.")
+		} else if issued.Revoked() {
+			writeKeyVaultTokenRevoked(w, r, vaultName, issued.RevokedAt)
+		} else if AuthorizeKeyVault(w, r, vaultName, "certificates", certificateName, CertificateReadAction) {
+			// Good
 			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(withCode)
-			json.NewEncoder(w).Encode(map[string]string{
-				"nonspecific error": "error retrieving secret",
-			})
-
+			w.WriteHeader(http.StatusOK)
+
+			certObject := &AzureCertificate{}
+			json.Unmarshal([]byte(`{    "attributes": {        "created": 1673029993,        "enabled": true,        "exp": 1704565993,        "nbf": 1673029393,        "recoverableDays": 7,        "recoveryLevel": "CustomizedRecoverable+Purgeable",        "updated": 1673029993    },    "cer": "MIIDPDCC...==",    "id": "https://localhost",    "kid": "https://localhost",    "pending": {        "id": "https://localhost"    },    "policy": {        "attributes": {            "created": 1673029989,            "enabled": true,            "updated": 1673029989        },        "id": "https://localhost",        "issuer": {            "name": "Self"        },        "key_props": {            "exportable": true,            "key_size": 2048,            "kty": "RSA",            "reuse_key": false        },        "lifetime_actions": [            {                "action": {                    "action_type": "AutoRenew"                },                "trigger": {                    "lifetime_percentage": 80                }            }        ],        "secret_props": {            "contentType": "application/x-pem-file"        },        "x509_props": {            "basic_constraints": {                "ca": false            },            "ekus": [                "1.3.6.1.5.5.7.3.1",                "1.3.6.1.5.5.7.3.2"            ],            "key_usage": [                "digitalSignature",                "keyEncipherment"            ],            "sans": {                "dns_names": []            },            "subject": "CN=test-certificate",            "validity_months": 12        }    },    "sid": "https://localhost",    "tags": {},    "x5t": "wOSk8759bvVk2tJc32vnVASBRLk"}`), certObject)
+
+			certObject.ID = fmt.Sprintf("%s/certificates/%s/%s", VaultBaseURL(r, vaultName), certificateName, certificateVersion)
+			certObject.Kid = fmt.Sprintf("%s/keys/%s/%s", VaultBaseURL(r, vaultName), certificateName, certificateVersion)
+			certObject.Sid = fmt.Sprintf("%s/certificates/%s/%s", VaultBaseURL(r, vaultName), certificateName, certificateVersion)
+			certObject.Policy.ID = fmt.Sprintf("%s/certificates/%s/policy", VaultBaseURL(r, vaultName), certificateName)
+			certObject.Pending.ID = fmt.Sprintf("%s/certificates/%s/pending", VaultBaseURL(r, vaultName), certificateName)
+			certObject.Attributes.Created = int(Config.FixtureEpoch)
+			certObject.Attributes.Updated = int(Config.FixtureEpoch)
+			certObject.Attributes.Nbf = int(Config.FixtureEpoch)
+			certObject.Attributes.Exp = int(Config.FixtureEpoch + fixtureLifetime)
+
+			json.NewEncoder(w).Encode(certObject)
 		}
+	} else {
+		// Unauthorized
+		SetKeyVaultChallenge(w, r, vaultName)
+		KeyVaultUnauthorized.Write(w, unauthorizedMessage(authHeader))
 	}
 }
 
@@ -398,170 +253,48 @@ func KeyVaultDeleteSecretDefault(w http.ResponseWriter, r *http.Request) {
 
 func KeyVaultGetSecret(w http.ResponseWriter, r *http.Request, secretVersion string) {
 	vars := mux.Vars(r)
-	secretName, ok := vars["secretName"]
-	if !ok {
-		log.Println("Not secretName specified")
-		// do an error
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"generic error": "error",
-		})
-	}
-	vaultName, ok := vars["vaultName"]
-	if !ok {
-		log.Println("Not vaultName specified")
-		// do an error
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"generic error": "error",
-		})
-	}
-
-	// Check if we want a fake error
-	var withCode int = 0
-	var err error
-
-	withCodeRaw := r.URL.Query().Get("withcode")
-	if withCodeRaw != "" {
-		withCode, err = strconv.Atoi(withCodeRaw)
-
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"error": map[string]string{
-					"code":    "internal server error",
-					"message": "could not parse 'withcode' as an integer when retrieving secret",
-				},
-			})
-
-			return
-		}
-	}
-
-	switch withCode {
-	case 500:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]string{
-				"code":    "internal server error",
-				"message": "error retrieving secret",
-			},
-		})
-
-		return
-
-	case 501:
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("<html><body>This is some HTML error that can happen</body></html>"))
-
-		return
-
-	case 502:
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"fault": map[string]string{
-				"msg": "good json syntax but badly formatted error message",
-			},
-		})
-
-		return
-
-	case 401:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(401)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]string{
-				"code":    "unauthorized",
-				"message": "invalid authentication credentials when retrieving secret",
-			},
-		})
-
-		return
-
-	case 403:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(403)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]string{
-				"code":    "forbidden",
-				"message": "not allowed on this specific tenant perhaps when retrieving secret",
-			},
-		})
+	secretName := vars["secretName"]
+	vaultName := vars["vaultName"]
 
+	if keyVaultFakeResponse(w, r, vaultName, "secrets", secretName) {
 		return
+	}
 
-	case 404:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(404)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]string{
-				"code":    "not_found",
-				"message": fmt.Sprintf("secret %s version %s not found in this keyvault", secretName, secretVersion),
-			},
-		})
+	authHeader := r.Header.Get("Authorization")
 
-		return
+	action := SecretGetAction
+	if r.Method == http.MethodDelete {
+		action = SecretDeleteAction
+	}
 
-	default:
-		if withCode == 0 || withCode == 200 {
-			authHeader := r.Header.Get("Authorization")
-
-			//if contains(Tokens, authHeader) {
-			if expiresAt, ok := Tokens[authHeader]; ok {
-				if time.Now().Unix() > expiresAt {
-					// Unauthorized
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusUnauthorized)
-					json.NewEncoder(w).Encode(AzureError{
-						&AzureErrorDetail{
-							Code:    "Unauthorized",
-							Message: "[BearerReadAccessTokenFailed] Token expired: 'S2S120010'.",
-						},
-					})
-				} else {
-					// Good
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusOK)
-					json.NewEncoder(w).Encode(KeyVaultGetSecretResponse{
-						Attributes: &KeyVaultAttributes{
-							Created:         1660313443,
-							Enabled:         true,
-							Expiry:          1723385117,
-							RecoverableDays: 7,
-							RecoveryLevel:   "CustomizedRecoverable+Purgeable",
-							Updated:         1660313868,
-						},
-						ID:    fmt.Sprintf("http://fakeazure:8081/keyvault/%s/secrets/%s/%s", vaultName, secretName, secretVersion),
-						Tags:  map[string]string{},
-						Value: "This is the fake secret value",
-					})
-				}
-			} else {
-				// Unauthorized
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusUnauthorized)
-				json.NewEncoder(w).Encode(AzureError{
-					&AzureErrorDetail{
-						Code:    "Unauthorized",
-						Message: "[BearerReadAccessTokenFailed] Error validating token: 'S2S12005'.",
-					},
-				})
-			}
-
-		} else {
-			// Nonspecific fake error code
+	if issued, ok := Tokens.Lookup(authHeader); ok {
+		if Now().Unix() > issued.ExpiresAt {
+			// Unauthorized
+			SetKeyVaultChallenge(w, r, vaultName)
+			KeyVaultUnauthorized.Write(w, "[BearerReadAccessTokenFailed] Token expired: 'S2S120010'.")
+		} else if issued.Revoked() {
+			writeKeyVaultTokenRevoked(w, r, vaultName, issued.RevokedAt)
+		} else if AuthorizeKeyVault(w, r, vaultName, "secrets", secretName, action) {
+			// Good
 			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(withCode)
-			json.NewEncoder(w).Encode(map[string]string{
-				"nonspecific error": "error retrieving secret",
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(KeyVaultGetSecretResponse{
+				Attributes: &KeyVaultAttributes{
+					Created:         Config.FixtureEpoch,
+					Enabled:         true,
+					Expiry:          Config.FixtureEpoch + fixtureLifetime,
+					RecoverableDays: 7,
+					RecoveryLevel:   "CustomizedRecoverable+Purgeable",
+					Updated:         Config.FixtureEpoch,
+				},
+				ID:    fmt.Sprintf("%s/secrets/%s/%s", VaultBaseURL(r, vaultName), secretName, secretVersion),
+				Tags:  map[string]string{},
+				Value: "This is the fake secret value",
 			})
-
 		}
+	} else {
+		// Unauthorized
+		SetKeyVaultChallenge(w, r, vaultName)
+		KeyVaultUnauthorized.Write(w, unauthorizedMessage(authHeader))
 	}
 }
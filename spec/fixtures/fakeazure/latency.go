@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Delay is how long a fault rule holds a request before answering it
+type Delay struct {
+	// fixed waits `ms`, uniform between `min_ms` and `max_ms`,
+	// and pareto `scale_ms` or more with a long tail set by `shape`, capped at `max_ms` if given
+	Distribution string  `json:"distribution"`
+	Ms           int     `json:"ms"`
+	MinMs        int     `json:"min_ms"`
+	MaxMs        int     `json:"max_ms"`
+	ScaleMs      int     `json:"scale_ms"`
+	Shape        float64 `json:"shape"`
+}
+
+// The slow modes of a fault rule, once any delay has passed
+const (
+	// never answer, until the client gives up
+	HangMode = "hang"
+	// send the status and headers, then never send the body
+	StallBodyMode = "stall_body"
+	// send the body a few bytes at a time
+	DripMode = "drip"
+)
+
+// maxDelay is the longest delay a Duration holds, some 292 years
+const maxDelay = time.Duration(math.MaxInt64)
+
+func (d *Delay) Duration() time.Duration {
+	ms := float64(d.Ms)
+
+	switch d.Distribution {
+	case "uniform":
+		ms = float64(d.MinMs) + rand.Float64()*float64(d.MaxMs-d.MinMs)
+
+	case "pareto":
+		ms = float64(d.ScaleMs) / math.Pow(1-rand.Float64(), 1/d.Shape)
+		if d.MaxMs > 0 && ms > float64(d.MaxMs) {
+			ms = float64(d.MaxMs)
+		}
+	}
+
+	// a heavy pareto tail without max_ms can reach past what a Duration holds, or infinity
+	nanoseconds := ms * float64(time.Millisecond)
+	if nanoseconds >= float64(maxDelay) {
+		return maxDelay
+	}
+
+	return time.Duration(nanoseconds)
+}
+
+func (d *Delay) validate() error {
+	switch d.Distribution {
+	case "", "fixed":
+		if d.Ms < 0 {
+			return errors.New("delay ms must not be negative")
+		}
+
+	case "uniform":
+		if d.MinMs < 0 || d.MaxMs < d.MinMs {
+			return errors.New("uniform delay needs 0 <= min_ms <= max_ms")
+		}
+
+	case "pareto":
+		if d.ScaleMs <= 0 || d.Shape <= 0 {
+			return errors.New("pareto delay needs a positive scale_ms and shape")
+		}
+
+	default:
+		return errors.New("delay distribution must be fixed, uniform or pareto")
+	}
+
+	return nil
+}
+
+// validateModes checks the delay and mode of a rule, including the network modes of chaos.go
+func (rule *FaultRule) validateModes() error {
+	if rule.Delay != nil {
+		if err := rule.Delay.validate(); err != nil {
+			return err
+		}
+	}
+
+	switch rule.Mode {
+	case "", HangMode, StallBodyMode, DripMode:
+	default:
+		if !isChaosMode(rule.Mode) {
+			return errors.New("mode must be hang, stall_body, drip, reset, truncate, bad_chunked, garbage or empty")
+		}
+	}
+
+	if rule.DripBytes < 0 || rule.DripIntervalMs < 0 {
+		return errors.New("drip_bytes and drip_interval_ms must not be negative")
+	}
+
+	return nil
+}
+
+// sleep waits for d, or until the client goes away, in which case it returns false
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// slowDown applies the delay and mode of a fault rule. It returns the writer to answer through,
+// or false when the client went away, or was made to, and nothing more should be written.
+func slowDown(w http.ResponseWriter, r *http.Request, rule *FaultRule) (http.ResponseWriter, bool) {
+	ctx := r.Context()
+
+	if rule.Delay != nil && !sleep(ctx, rule.Delay.Duration()) {
+		return w, false
+	}
+
+	switch rule.Mode {
+	case HangMode:
+		<-ctx.Done()
+		return w, false
+
+	case StallBodyMode:
+		return &stallingWriter{ResponseWriter: w, ctx: ctx}, true
+
+	case DripMode:
+		dripBytes := rule.DripBytes
+		if dripBytes == 0 {
+			dripBytes = 1
+		}
+		interval := time.Duration(rule.DripIntervalMs) * time.Millisecond
+		if interval == 0 {
+			interval = 100 * time.Millisecond
+		}
+
+		return &drippingWriter{ResponseWriter: w, ctx: ctx, bytes: dripBytes, interval: interval}, true
+	}
+
+	return w, true
+}
+
+func flush(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// stallingWriter lets the status and headers out, then blocks the first body write until the client gives up
+type stallingWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	wroteHeader bool
+}
+
+func (s *stallingWriter) WriteHeader(status int) {
+	s.wroteHeader = true
+	s.ResponseWriter.WriteHeader(status)
+	flush(s.ResponseWriter)
+}
+
+func (s *stallingWriter) Write(p []byte) (int, error) {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+
+	<-s.ctx.Done()
+
+	return 0, s.ctx.Err()
+}
+
+// drippingWriter sends the body a few bytes at a time, flushing each piece
+type drippingWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	bytes    int
+	interval time.Duration
+}
+
+func (d *drippingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		end := written + d.bytes
+		if end > len(p) {
+			end = len(p)
+		}
+
+		n, err := d.ResponseWriter.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		flush(d.ResponseWriter)
+
+		if written < len(p) && !sleep(d.ctx, d.interval) {
+			return written, d.ctx.Err()
+		}
+	}
+
+	return written, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParetoDelayNeverWraps draws from tails heavy enough to overflow a Duration, which must be
+// clamped rather than turn negative
+func TestParetoDelayNeverWraps(t *testing.T) {
+	for _, shape := range []float64{0.01, 0.05, 0.2} {
+		delay := &Delay{Distribution: "pareto", ScaleMs: 50, Shape: shape}
+
+		for i := 0; i < 10000; i++ {
+			if got := delay.Duration(); got < 50*time.Millisecond {
+				t.Fatalf("pareto delay with shape %v was %v, below scale_ms", shape, got)
+			}
+		}
+	}
+}
+
+func TestParetoDelayCappedAtMax(t *testing.T) {
+	delay := &Delay{Distribution: "pareto", ScaleMs: 50, Shape: 0.01, MaxMs: 1000}
+
+	for i := 0; i < 1000; i++ {
+		if got := delay.Duration(); got > time.Second {
+			t.Fatalf("pareto delay was %v, above max_ms", got)
+		}
+	}
+}
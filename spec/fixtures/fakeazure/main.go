@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"math/rand"
 	"net/http"
@@ -9,20 +10,9 @@ import (
 	"github.com/gorilla/mux"
 )
 
-var Tokens map[string]int64 = map[string]int64{}
-
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 var serverAddress string = "0.0.0.0:8081"
 
-type AzureErrorDetail struct {
-	Code    string `json:"code"`
-	Message string `json:"Message"`
-}
-
-type AzureError struct {
-	Error *AzureErrorDetail `json:"error"`
-}
-
 func RandStringRunes(length int) string {
 	b := make([]rune, length)
 	for i := range b {
@@ -31,21 +21,99 @@ func RandStringRunes(length int) string {
 	return string(b)
 }
 
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": message,
+	})
+}
+
 func main() {
 	rand.Seed(time.Now().UnixNano())
+	LoadConfig()
+	Tokens.StartSweeper(time.Duration(Config.TokenStore.SweepInterval)*time.Second, int64(Config.TokenStore.Retention))
+
+	handler := NewHandler()
+	ListenForClouds(handler)
 
+	log.Printf("Starting fakeazure server on %s\n", serverAddress)
+	http.ListenAndServe(serverAddress, handler)
+}
+
+// NewHandler routes every fakeazure endpoint, behind the fault injection and record/replay layers
+func NewHandler() http.Handler {
 	r := mux.NewRouter()
+	// vaults addressed by their DNS name, e.g. through a hosts entry for jack-vault.vault.azure.net
+	for _, profile := range CloudProfiles {
+		registerKeyVaultRoutes(r.Host("{vaultName}." + profile.KeyVaultSuffix).Subrouter())
+	}
 	r.HandleFunc("/{tenantId}/oauth2/v2.0/token", OAuthTokenPost).Methods("POST")
 	r.HandleFunc("/authority/{tenantId}/oauth2/v2.0/token", OAuthTokenPost).Methods("POST")
-	r.HandleFunc("/keyvault/{vaultName}/secrets/{secretName}", KeyVaultGetSecretDefault).Methods("GET")
-	r.HandleFunc("/keyvault/{vaultName}/secrets/{secretName}", KeyVaultDeleteSecretDefault).Methods("DELETE")
-	r.HandleFunc("/keyvault/{vaultName}/secrets/{secretName}/{secretVersion}", KeyVaultGetSecretVersion).Methods("GET")
-	r.HandleFunc("/keyvault/{vaultName}/certificates/{certificateName}", KeyVaultGetCertificateDefault).Methods("GET")
-	r.HandleFunc("/keyvault/{vaultName}/certificates/{certificateName}/{certificateVersion}", KeyVaultGetCertificateVersion).Methods("GET")
-	r.HandleFunc("/keyvault/{vaultName}/keys/{keyName}", KeyVaultGetKeyDefault).Methods("GET")
-	r.HandleFunc("/keyvault/{vaultName}/keys/{keyName}/{keyVersion}", KeyVaultGetKeyVersion).Methods("GET")
+	r.HandleFunc("/{tenantId}/oauth2/v2.0/authorize", OAuthAuthorizeGet).Methods("GET")
+	r.HandleFunc("/authority/{tenantId}/oauth2/v2.0/authorize", OAuthAuthorizeGet).Methods("GET")
+	r.HandleFunc("/{tenantId}/oauth2/v2.0/devicecode", OAuthDeviceCodePost).Methods("POST")
+	r.HandleFunc("/authority/{tenantId}/oauth2/v2.0/devicecode", OAuthDeviceCodePost).Methods("POST")
+	r.HandleFunc("/{tenantId}/oauth2/token", OAuthV1TokenPost).Methods("POST")
+	r.HandleFunc("/authority/{tenantId}/oauth2/token", OAuthV1TokenPost).Methods("POST")
+	r.HandleFunc("/common/discovery/instance", InstanceDiscoveryGet).Methods("GET")
+	r.HandleFunc("/authority/common/discovery/instance", InstanceDiscoveryGet).Methods("GET")
+	r.HandleFunc("/common/userrealm/{username}", UserRealmGet).Methods("GET")
+	r.HandleFunc("/authority/common/userrealm/{username}", UserRealmGet).Methods("GET")
+	r.HandleFunc("/{tenantId}/v2.0/.well-known/openid-configuration", OpenIDConfigurationGet).Methods("GET")
+	r.HandleFunc("/authority/{tenantId}/v2.0/.well-known/openid-configuration", OpenIDConfigurationGet).Methods("GET")
+	r.HandleFunc("/{tenantId}/.well-known/openid-configuration", OpenIDConfigurationGet).Methods("GET")
+	r.HandleFunc("/authority/{tenantId}/.well-known/openid-configuration", OpenIDConfigurationGet).Methods("GET")
+	r.HandleFunc("/{tenantId}/discovery/v2.0/keys", SigningKeysGet).Methods("GET")
+	r.HandleFunc("/authority/{tenantId}/discovery/v2.0/keys", SigningKeysGet).Methods("GET")
+	r.HandleFunc("/{tenantId}/discovery/keys", SigningKeysGet).Methods("GET")
+	r.HandleFunc("/authority/{tenantId}/discovery/keys", SigningKeysGet).Methods("GET")
+	registerKeyVaultRoutes(r.PathPrefix("/keyvault/{vaultName}").Subrouter())
 	r.HandleFunc("/metadata/identity/oauth2/token", InstanceMetadataTokenGet).Methods("GET")
+	r.HandleFunc("/admin/devicecodes/{userCode}/approve", AdminDeviceCodeApprove).Methods("POST")
+	r.HandleFunc("/admin/devicecodes/{userCode}/decline", AdminDeviceCodeDecline).Methods("POST")
+	r.HandleFunc("/admin/checkAccess", AdminCheckAccess).Methods("POST")
+	r.HandleFunc("/admin/roleDefinitions", AdminRoleDefinitionsGet).Methods("GET")
+	r.HandleFunc("/admin/roleDefinitions/{roleDefinitionId}", AdminRoleDefinitionPut).Methods("PUT")
+	r.HandleFunc("/admin/roleDefinitions/{roleDefinitionId}", AdminRoleDefinitionDelete).Methods("DELETE")
+	r.HandleFunc("/admin/roleAssignments", AdminRoleAssignmentsGet).Methods("GET")
+	r.HandleFunc("/admin/roleAssignments/{assignmentId}", AdminRoleAssignmentPut).Methods("PUT")
+	r.HandleFunc("/admin/roleAssignments/{assignmentId}", AdminRoleAssignmentDelete).Methods("DELETE")
+	r.HandleFunc("/admin/vaults/{vaultName}", AdminVaultGet).Methods("GET")
+	r.HandleFunc("/admin/vaults/{vaultName}", AdminVaultPatch).Methods("PATCH")
+	r.HandleFunc("/admin/users/{userId}/revokeSignInSessions", AdminRevokeSignInSessions).Methods("POST")
+	r.HandleFunc("/admin/tokens", AdminTokensGet).Methods("GET")
+	r.HandleFunc("/admin/tokens/revoke", AdminRevokeTokens).Methods("POST")
+	r.HandleFunc("/admin/clock", AdminClockGet).Methods("GET")
+	r.HandleFunc("/admin/clock/freeze", AdminClockFreeze).Methods("POST")
+	r.HandleFunc("/admin/clock/advance", AdminClockAdvance).Methods("POST")
+	r.HandleFunc("/admin/clock/set", AdminClockSet).Methods("POST")
+	r.HandleFunc("/admin/clock/reset", AdminClockReset).Methods("POST")
+	r.HandleFunc("/admin/throttling", AdminThrottlingGet).Methods("GET")
+	r.HandleFunc("/admin/throttling", AdminThrottlingPut).Methods("PUT")
+	r.HandleFunc("/admin/faults", AdminFaultsGet).Methods("GET")
+	r.HandleFunc("/admin/faults", AdminFaultsDelete).Methods("DELETE")
+	r.HandleFunc("/admin/faults/{faultId}", AdminFaultPut).Methods("PUT")
+	r.HandleFunc("/admin/faults/{faultId}", AdminFaultDelete).Methods("DELETE")
+	r.HandleFunc("/admin/clientFaults", AdminClientFaultsGet).Methods("GET")
+	r.HandleFunc("/admin/clientFaults/{clientId}", AdminClientFaultPut).Methods("PUT")
+	r.HandleFunc("/admin/clientFaults/{clientId}", AdminClientFaultDelete).Methods("DELETE")
+	r.HandleFunc("/admin/proxy", AdminProxyGet).Methods("GET")
+	r.HandleFunc("/admin/proxy", AdminProxyPut).Methods("PUT")
+	r.HandleFunc("/arc/metadata/identity/oauth2/token", ArcTokenGet).Methods("GET")
+	r.HandleFunc("/MSI/token", AppServiceTokenGet).Methods("GET")
+	r.HandleFunc("/MSI/token/", AppServiceTokenGet).Methods("GET")
 
-	log.Printf("Starting fakeazure server on %s\n", serverAddress)
-	http.ListenAndServe(serverAddress, r)
+	return InjectFaults(RecordReplay(r))
+}
+
+func registerKeyVaultRoutes(v *mux.Router) {
+	v.Use(ThrottleKeyVault)
+	v.HandleFunc("/secrets/{secretName}", KeyVaultGetSecretDefault).Methods("GET")
+	v.HandleFunc("/secrets/{secretName}", KeyVaultDeleteSecretDefault).Methods("DELETE")
+	v.HandleFunc("/secrets/{secretName}/{secretVersion}", KeyVaultGetSecretVersion).Methods("GET")
+	v.HandleFunc("/certificates/{certificateName}", KeyVaultGetCertificateDefault).Methods("GET")
+	v.HandleFunc("/certificates/{certificateName}/{certificateVersion}", KeyVaultGetCertificateVersion).Methods("GET")
+	v.HandleFunc("/keys/{keyName}", KeyVaultGetKeyDefault).Methods("GET")
+	v.HandleFunc("/keys/{keyName}/{keyVersion}", KeyVaultGetKeyVersion).Methods("GET")
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testHandler is the whole of fakeazure, as the server runs it
+var testHandler = NewHandler()
+
+// withDefaultConfig runs a test against the default config, and puts back the one it replaced
+func withDefaultConfig(t *testing.T) {
+	previous := Config
+	Config = DefaultConfig()
+	t.Cleanup(func() { Config = previous })
+}
+
+// serve sends a request through testHandler
+func serve(method string, target string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	recorder := httptest.NewRecorder()
+	testHandler.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+// postForm sends a form-encoded POST, as token requests are
+func postForm(target string, form url.Values) *httptest.ResponseRecorder {
+	return serve(http.MethodPost, target, form.Encode(), map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+}
+
+// decodeBody decodes a JSON answer, failing the test when it is not JSON
+func decodeBody(t *testing.T, recorder *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("answer is not JSON: %s: %q", err, recorder.Body.String())
+	}
+
+	return body
+}
+
+// expectStatus fails the test when the answer has another status
+func expectStatus(t *testing.T, recorder *httptest.ResponseRecorder, status int) {
+	t.Helper()
+
+	if recorder.Code != status {
+		t.Fatalf("answered %d, want %d: %s", recorder.Code, status, recorder.Body.String())
+	}
+}
+
+// expectAADError fails the test unless the answer is an OAuth error carrying the AADSTS code
+func expectAADError(t *testing.T, recorder *httptest.ResponseRecorder, code int) {
+	t.Helper()
+
+	body := decodeBody(t, recorder)
+	codes, _ := body["error_codes"].([]interface{})
+	if len(codes) != 1 || codes[0] != float64(code) {
+		t.Fatalf("answer is not AADSTS%d: %v", code, body)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IMDS returns every numeric field as a string, unlike the AAD v2 endpoint
+type ManagedIdentityResponse struct {
+	AccessToken  string `json:"access_token"`
+	ClientID     string `json:"client_id"`
+	ExpiresIn    string `json:"expires_in"`
+	ExpiresOn    string `json:"expires_on"`
+	ExtExpiresIn string `json:"ext_expires_in"`
+	NotBefore    string `json:"not_before"`
+	Resource     string `json:"resource"`
+	TokenType    string `json:"token_type"`
+}
+
+// ManagedIdentityErrorResponse is the error body of IMDS and Arc
+type ManagedIdentityErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// managedIdentitySwitches reads the ?withcodemanagedidentity= and ?withexpiry= switches shared by the
+// managed identity endpoints. It returns the status to fail with (0 for none) and the token lifetime,
+// or the name of a switch that is not an integer.
+func managedIdentitySwitches(r *http.Request) (int, int, string) {
+	withCode := 0
+	if raw := FaultSwitch(r, "withcodemanagedidentity"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return 0, 0, "withcode"
+		}
+		withCode = parsed
+	}
+
+	withExpiry := 30
+	if raw := FaultSwitch(r, "withexpiry"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return 0, 0, "withexpiry"
+		}
+		withExpiry = parsed
+	}
+
+	if withCode == http.StatusOK {
+		withCode = 0
+	}
+
+	return withCode, withExpiry, ""
+}
+
+// SelectManagedIdentity picks the identity addressed by client_id, object_id or msi_res_id.
+// With none of them, the system-assigned identity wins, then a lone user-assigned identity.
+func SelectManagedIdentity(clientID string, objectID string, resourceID string) (*ManagedIdentity, string) {
+	given := 0
+	for _, selector := range []string{clientID, objectID, resourceID} {
+		if selector != "" {
+			given++
+		}
+	}
+
+	if given > 1 {
+		return nil, "Only one managed identity selector may be specified"
+	}
+
+	if given == 0 {
+		if Config.ManagedIdentities.SystemAssigned != nil {
+			return Config.ManagedIdentities.SystemAssigned, ""
+		}
+
+		switch len(Config.ManagedIdentities.UserAssigned) {
+		case 0:
+			return nil, "Identity not found"
+		case 1:
+			return Config.ManagedIdentities.UserAssigned[0], ""
+		default:
+			return nil, "Multiple user assigned identities exist, please specify the clientId / resourceId of the identity in the token request"
+		}
+	}
+
+	for _, identity := range Config.ManagedIdentities.UserAssigned {
+		if (clientID != "" && identity.ClientID == clientID) ||
+			(objectID != "" && identity.ObjectID == objectID) ||
+			(resourceID != "" && identity.ResourceID == resourceID) {
+			return identity, ""
+		}
+	}
+
+	return nil, "Identity not found"
+}
+
+func InstanceMetadataTokenGet(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Metadata") != "true" {
+		ManagedIdentityMissingMetadata.Write(w)
+		return
+	}
+
+	if r.Header.Get("X-Forwarded-For") != "" {
+		ManagedIdentityForwarded.Write(w)
+		return
+	}
+
+	// Check if we want a fake error
+	withCode, withExpiry, badSwitch := managedIdentitySwitches(r)
+	if badSwitch != "" {
+		ManagedIdentityInternalError.Write(w, "could not parse '"+badSwitch+"' as an integer")
+		return
+	}
+
+	if withCode != 0 {
+		ManagedIdentityErrorFor(withCode).Write(w)
+		return
+	}
+
+	query := r.URL.Query()
+
+	if query.Get("api-version") == "" {
+		ManagedIdentityMissingAPIVersion.Write(w)
+		return
+	}
+
+	resource := query.Get("resource")
+	if resource == "" {
+		ManagedIdentityMissingResource.Write(w)
+		return
+	}
+
+	identity, reason := SelectManagedIdentity(query.Get("client_id"), query.Get("object_id"), query.Get("msi_res_id"))
+	if identity == nil {
+		ManagedIdentityNotSelected.Write(w, reason)
+		return
+	}
+
+	// Good, generate a fake Bearer for the selected identity and cache it as authorised
+	now := Now().Unix()
+	token, expiresAt := IssueManagedIdentityToken(CloudFor(r), identity, resource, now, withExpiry)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ManagedIdentityResponse{
+		AccessToken:  token,
+		ClientID:     identity.ClientID,
+		ExpiresIn:    strconv.Itoa(withExpiry),
+		ExpiresOn:    strconv.FormatInt(expiresAt, 10),
+		ExtExpiresIn: strconv.Itoa(withExpiry),
+		NotBefore:    strconv.FormatInt(now, 10),
+		Resource:     resource,
+		TokenType:    "Bearer",
+	})
+}
+
+// IssueManagedIdentityToken mints an app-only token for the identity, audienced to the resource
+func IssueManagedIdentityToken(cloud *CloudProfile, identity *ManagedIdentity, resource string, now int64, lifetime int) (string, int64) {
+	tenantID := identity.TenantFor()
+	expiresAt := now + int64(lifetime)
+
+	token := IssueToken(Claims{
+		"aud":       resource,
+		"iss":       cloud.Issuer(tenantID, "1.0"),
+		"iat":       now,
+		"nbf":       now,
+		"exp":       expiresAt,
+		"appid":     identity.ClientID,
+		"appidacr":  "2",
+		"idtyp":     "app",
+		"oid":       identity.ObjectID,
+		"sub":       identity.ObjectID,
+		"tid":       tenantID,
+		"xms_mirid": identity.ResourceID,
+		"ver":       "1.0",
+		"uti":       RandStringRunes(22),
+	})
+
+	return token, expiresAt
+}
+
+// App Service answers with only expires_on, and reports errors in its own envelope
+type AppServiceTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ClientID    string `json:"client_id"`
+	ExpiresOn   string `json:"expires_on"`
+	Resource    string `json:"resource"`
+	TokenType   string `json:"token_type"`
+}
+
+// AppServiceErrorResponse is the error envelope of App Service and Functions
+type AppServiceErrorResponse struct {
+	StatusCode    int    `json:"statusCode"`
+	Message       string `json:"message"`
+	CorrelationID string `json:"correlationId"`
+}
+
+func AppServiceTokenGet(w http.ResponseWriter, r *http.Request) {
+	identityHeader := r.Header.Get("X-IDENTITY-HEADER")
+	if identityHeader == "" {
+		AppServiceMissingIdentityHeader.WriteAppService(w)
+		return
+	}
+
+	if identityHeader != Config.AppService.IdentityHeader {
+		AppServiceWrongIdentityHeader.WriteAppService(w)
+		return
+	}
+
+	withCode, withExpiry, badSwitch := managedIdentitySwitches(r)
+	if badSwitch != "" {
+		ManagedIdentityInternalError.WriteAppService(w, "could not parse '"+badSwitch+"' as an integer")
+		return
+	}
+
+	if withCode != 0 {
+		ManagedIdentityErrorFor(withCode).WriteAppService(w)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("api-version") != "2019-08-01" {
+		AppServiceUnsupportedAPIVersion.WriteAppService(w)
+		return
+	}
+
+	resource := query.Get("resource")
+	if resource == "" {
+		AppServiceMissingResource.WriteAppService(w)
+		return
+	}
+
+	identity, reason := SelectManagedIdentity(query.Get("client_id"), query.Get("principal_id"), query.Get("mi_res_id"))
+	if identity == nil {
+		ManagedIdentityNotSelected.WriteAppService(w, reason)
+		return
+	}
+
+	token, expiresAt := IssueManagedIdentityToken(CloudFor(r), identity, resource, Now().Unix(), withExpiry)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AppServiceTokenResponse{
+		AccessToken: token,
+		ClientID:    identity.ClientID,
+		ExpiresOn:   strconv.FormatInt(expiresAt, 10),
+		Resource:    resource,
+		TokenType:   "Bearer",
+	})
+}
+
+// arcSecrets holds the contents of every challenge .key file not yet redeemed
+var arcSecrets = map[string]string{}
+var arcSecretsLock sync.Mutex
+
+// ArcTokenGet emulates the Azure Connected Machine agent, which only hands out a token to
+// callers that can read the key file named in its Basic challenge.
+func ArcTokenGet(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Metadata") != "true" {
+		ManagedIdentityMissingMetadata.Write(w)
+		return
+	}
+
+	withCode, withExpiry, badSwitch := managedIdentitySwitches(r)
+	if badSwitch != "" {
+		ManagedIdentityInternalError.Write(w, "could not parse '"+badSwitch+"' as an integer")
+		return
+	}
+
+	if withCode != 0 {
+		ManagedIdentityErrorFor(withCode).Write(w)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("api-version") == "" {
+		ManagedIdentityMissingAPIVersion.Write(w)
+		return
+	}
+
+	resource := query.Get("resource")
+	if resource == "" {
+		ManagedIdentityMissingResource.Write(w)
+		return
+	}
+
+	if query.Get("client_id") != "" || query.Get("object_id") != "" || query.Get("msi_res_id") != "" {
+		ManagedIdentityUserAssignedOnArc.Write(w)
+		return
+	}
+
+	identity := Config.ManagedIdentities.SystemAssigned
+	if identity == nil {
+		ManagedIdentityNotFound.Write(w)
+		return
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Basic ") {
+		keyFile, err := writeArcKeyFile()
+		if err != nil {
+			log.Printf("could not write arc key file: %s\n", err)
+			ManagedIdentityInternalError.Write(w, "could not write the challenge key file")
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%s", keyFile))
+		ManagedIdentityChallengeRequired.Write(w)
+		return
+	}
+
+	if !redeemArcSecret(strings.TrimPrefix(authHeader, "Basic ")) {
+		ManagedIdentityChallengeMismatch.Write(w)
+		return
+	}
+
+	now := Now().Unix()
+	token, expiresAt := IssueManagedIdentityToken(CloudFor(r), identity, resource, now, withExpiry)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ManagedIdentityResponse{
+		AccessToken:  token,
+		ClientID:     identity.ClientID,
+		ExpiresIn:    strconv.Itoa(withExpiry),
+		ExpiresOn:    strconv.FormatInt(expiresAt, 10),
+		ExtExpiresIn: strconv.Itoa(withExpiry),
+		NotBefore:    strconv.FormatInt(now, 10),
+		Resource:     resource,
+		TokenType:    "Bearer",
+	})
+}
+
+func writeArcKeyFile() (string, error) {
+	if err := os.MkdirAll(Config.Arc.KeyDirectory, 0755); err != nil {
+		return "", err
+	}
+
+	secret := RandStringRunes(64)
+	keyFile := filepath.Join(Config.Arc.KeyDirectory, RandStringRunes(32)+".key")
+
+	// readable by other local users, so the client under test does not need to share our uid
+	if err := ioutil.WriteFile(keyFile, []byte(secret), 0644); err != nil {
+		return "", err
+	}
+
+	arcSecretsLock.Lock()
+	arcSecrets[secret] = keyFile
+	arcSecretsLock.Unlock()
+
+	return keyFile, nil
+}
+
+// redeemArcSecret accepts each key file once, then removes it like the agent does
+func redeemArcSecret(secret string) bool {
+	arcSecretsLock.Lock()
+	keyFile, ok := arcSecrets[secret]
+	delete(arcSecrets, secret)
+	arcSecretsLock.Unlock()
+
+	if ok {
+		os.Remove(keyFile)
+	}
+
+	return ok
+}
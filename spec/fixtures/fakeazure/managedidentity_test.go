@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAppServiceTokenGet(t *testing.T) {
+	withDefaultConfig(t)
+
+	const target = "/MSI/token/?api-version=2019-08-01&resource=https://vault.azure.net"
+
+	recorder := serve(http.MethodGet, target, "", nil)
+	expectStatus(t, recorder, http.StatusBadRequest)
+
+	recorder = serve(http.MethodGet, target, "", map[string]string{"X-IDENTITY-HEADER": "wrong"})
+	expectStatus(t, recorder, http.StatusUnauthorized)
+	if body := decodeBody(t, recorder); body["statusCode"] != float64(http.StatusUnauthorized) || body["correlationId"] == "" {
+		t.Fatalf("error is not in the App Service envelope: %v", body)
+	}
+
+	recorder = serve(http.MethodGet, "/MSI/token/?api-version=2017-09-01&resource=https://vault.azure.net", "", map[string]string{"X-IDENTITY-HEADER": "fake_identity_header"})
+	expectStatus(t, recorder, http.StatusBadRequest)
+
+	recorder = serve(http.MethodGet, target+"&client_id=fake_client", "", map[string]string{"X-IDENTITY-HEADER": "fake_identity_header"})
+	expectStatus(t, recorder, http.StatusOK)
+
+	body := decodeBody(t, recorder)
+	if body["client_id"] != "fake_client" || body["resource"] != "https://vault.azure.net" || body["token_type"] != "Bearer" {
+		t.Fatalf("unexpected token response: %v", body)
+	}
+	if _, ok := body["expires_on"].(string); !ok {
+		t.Fatalf("expires_on is not a string: %v", body["expires_on"])
+	}
+
+	issued, ok := Tokens.Lookup("Bearer " + body["access_token"].(string))
+	if !ok || issued.ClientID != "fake_client" {
+		t.Fatalf("token was not issued to the selected identity: %+v", issued)
+	}
+}
+
+func TestArcTokenGetChallenge(t *testing.T) {
+	withDefaultConfig(t)
+	Config.Arc.KeyDirectory = t.TempDir()
+
+	const target = "/arc/metadata/identity/oauth2/token?api-version=2020-06-01&resource=https://vault.azure.net"
+	metadata := map[string]string{"Metadata": "true"}
+
+	recorder := serve(http.MethodGet, target, "", metadata)
+	expectStatus(t, recorder, http.StatusUnauthorized)
+
+	challenge := recorder.Header().Get("WWW-Authenticate")
+	if !strings.HasPrefix(challenge, "Basic realm="+Config.Arc.KeyDirectory) {
+		t.Fatalf("challenge does not name a key file in the key directory: %q", challenge)
+	}
+
+	keyFile := strings.TrimPrefix(challenge, "Basic realm=")
+	secret, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		t.Fatalf("could not read the challenge key file: %s", err)
+	}
+
+	authorized := map[string]string{"Metadata": "true", "Authorization": "Basic " + string(secret)}
+
+	recorder = serve(http.MethodGet, target, "", authorized)
+	expectStatus(t, recorder, http.StatusOK)
+	if body := decodeBody(t, recorder); body["client_id"] != Config.ManagedIdentities.SystemAssigned.ClientID {
+		t.Fatalf("token was not for the system-assigned identity: %v", body)
+	}
+
+	if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+		t.Fatalf("key file was not deleted once redeemed: %v", err)
+	}
+
+	// each key file is good for one token only
+	recorder = serve(http.MethodGet, target, "", authorized)
+	expectStatus(t, recorder, http.StatusUnauthorized)
+
+	recorder = serve(http.MethodGet, target+"&client_id=fake_client", "", authorized)
+	expectStatus(t, recorder, http.StatusBadRequest)
+}
+
+func TestManagedIdentityFaultSwitches(t *testing.T) {
+	withDefaultConfig(t)
+	Config.Arc.KeyDirectory = t.TempDir()
+
+	endpoints := []struct {
+		name    string
+		target  string
+		headers map[string]string
+		field   string
+	}{
+		{"IMDS", "/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https://vault.azure.net", map[string]string{"Metadata": "true"}, "error"},
+		{"App Service", "/MSI/token/?api-version=2019-08-01&resource=https://vault.azure.net", map[string]string{"X-IDENTITY-HEADER": "fake_identity_header"}, "statusCode"},
+		{"Arc", "/arc/metadata/identity/oauth2/token?api-version=2020-06-01&resource=https://vault.azure.net", map[string]string{"Metadata": "true"}, "error"},
+	}
+
+	for _, endpoint := range endpoints {
+		headers := map[string]string{"X-Fakeazure-Fault": "withcodemanagedidentity=503"}
+		for name, value := range endpoint.headers {
+			headers[name] = value
+		}
+
+		recorder := serve(http.MethodGet, endpoint.target, "", headers)
+		expectStatus(t, recorder, http.StatusServiceUnavailable)
+		if body := decodeBody(t, recorder); body[endpoint.field] == nil {
+			t.Fatalf("%s fault is not in the endpoint's error shape: %v", endpoint.name, body)
+		}
+
+		// client switches apply as well, and the query string wins over them
+		Config.ClientFaults = map[string]string{"fake_client": "withcodemanagedidentity=429"}
+		expectStatus(t, serve(http.MethodGet, endpoint.target+"&client_id=fake_client", "", endpoint.headers), http.StatusTooManyRequests)
+		expectStatus(t, serve(http.MethodGet, endpoint.target+"&client_id=fake_client&withcodemanagedidentity=400", "", endpoint.headers), http.StatusBadRequest)
+		Config.ClientFaults = nil
+	}
+
+	headers := map[string]string{"X-IDENTITY-HEADER": "fake_identity_header", "X-Fakeazure-Fault": "withexpiry=5"}
+	recorder := serve(http.MethodGet, endpoints[1].target, "", headers)
+	expectStatus(t, recorder, http.StatusOK)
+
+	issued, _ := Tokens.Lookup("Bearer " + decodeBody(t, recorder)["access_token"].(string))
+	if issued.ExpiresAt-issued.IssuedAt != 5 {
+		t.Fatalf("withexpiry from the header did not set the lifetime: issued %d, expires %d", issued.IssuedAt, issued.ExpiresAt)
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
+// OAuthRequest holds the form-encoded fields shared by every grant, see ParseOAuthRequest
 type OAuthRequest struct {
-	ClientID     string `json:"client_id"`
-	ClientSecret string `json:"client_secret"`
-	GrantType    string `json:"grant_type"`
-	Scope        string `json:"scope"`
+	GrantType           string
+	ClientID            string
+	ClientSecret        string
+	ClientAssertion     string
+	ClientAssertionType string
+	Scope               string
+	Resource            string
+	Claims              string
 }
 
 type OAuthResponse struct {
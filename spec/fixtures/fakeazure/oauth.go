@@ -1,204 +1,338 @@
 package main
 
 import (
+	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
-	"time"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
 
-func InstanceMetadataTokenGet(w http.ResponseWriter, r *http.Request) {
-	// Check if we want a fake error
-	var withCode int = 0
-	var err error
+// AAD v1 returns its numeric fields as strings, and names the audience as `resource`
+type OAuthV1Response struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    string `json:"expires_in"`
+	ExpiresOn    string `json:"expires_on"`
+	ExtExpiresIn string `json:"ext_expires_in"`
+	NotBefore    string `json:"not_before"`
+	Resource     string `json:"resource"`
+	TokenType    string `json:"token_type"`
+}
 
-	withCodeRaw := r.URL.Query().Get("withcodemanagedidentity")
-	if withCodeRaw != "" {
-		withCode, err = strconv.Atoi(withCodeRaw)
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	ErrorCodes       []int  `json:"error_codes"`
+	Timestamp        string `json:"timestamp"`
+	TraceID          string `json:"trace_id"`
+	CorrelationID    string `json:"correlation_id"`
+}
 
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{
-				"internal server error": "could not parse 'withcode' as an integer",
-			})
+func writeOAuthError(w http.ResponseWriter, status int, errorName string, code int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(OAuthErrorResponse{
+		Error:            errorName,
+		ErrorDescription: fmt.Sprintf("AADSTS%d: %s", code, description),
+		ErrorCodes:       []int{code},
+		Timestamp:        Now().UTC().Format("2006-01-02 15:04:05Z"),
+		TraceID:          ObjectIDFor(RandStringRunes(16)),
+		CorrelationID:    ObjectIDFor(RandStringRunes(16)),
+	})
+}
 
-			return
-		}
+// ObjectIDFor derives a stable, GUID-shaped object ID for a principal that has not been configured
+func ObjectIDFor(name string) string {
+	sum := sha1.Sum([]byte(name))
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// IssueAppToken mints an app-only (client credentials) token and caches it as authorised
+func IssueAppToken(cloud *CloudProfile, tenantID string, clientID string, audience string, version string, now int64, lifetime int) (string, int64) {
+	expiresAt := now + int64(lifetime)
+
+	token := IssueToken(Claims{
+		"aud":      audience,
+		"iss":      cloud.Issuer(tenantID, version),
+		"iat":      now,
+		"nbf":      now,
+		"exp":      expiresAt,
+		"appid":    clientID,
+		"appidacr": "1",
+		"idtyp":    "app",
+		"oid":      PrincipalIDFor(clientID),
+		"sub":      PrincipalIDFor(clientID),
+		"tid":      tenantID,
+		"ver":      version,
+		"uti":      RandStringRunes(22),
+	})
+
+	return token, expiresAt
+}
+
+func OAuthTokenPost(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenantId"]
+
+	withExpiry, done := oauthFakeResponse(w, r)
+	if done {
+		return
 	}
 
-	var withExpiry int = 30
-	withExpiryRaw := r.URL.Query().Get("withexpiry")
-	if withExpiryRaw != "" {
-		withExpiry, err = strconv.Atoi(withExpiryRaw)
+	request, ok := ParseOAuthRequest(w, r)
+	if !ok || !allowTokenRequest(w, tenantID, request.ClientID) {
+		return
+	}
 
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{
-				"internal server error": "could not parse 'withexpiry' as an integer",
-			})
+	switch request.GrantType {
+	case "authorization_code":
+		oauthAuthorizationCodeGrant(w, r, tenantID, withExpiry)
+		return
+
+	case "refresh_token":
+		oauthRefreshTokenGrant(w, r, tenantID, withExpiry)
+		return
+
+	case deviceCodeGrantType:
+		oauthDeviceCodeGrant(w, r, tenantID, withExpiry)
+		return
 
-			return
+	case jwtBearerGrantType:
+		// on-behalf-of is only open to confidential clients
+		if validateClientCredential(w, request) {
+			oauthOnBehalfOfGrant(w, r, tenantID, withExpiry)
 		}
+		return
+
+	case "client_credentials":
+		// handled below
+
+	default:
+		AADUnsupportedGrantType.Write(w, request.GrantType)
+		return
 	}
 
-	switch withCode {
-	case 500:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"internal server error on managed identiy endpoint": "error",
-		})
+	if request.Scope == "" {
+		AADMissingParameter.Write(w, "scope")
+		return
+	}
 
+	// client credentials can only ask for the static permissions of a single resource
+	scopes := strings.Fields(request.Scope)
+	if len(scopes) != 1 || !strings.HasSuffix(scopes[0], "/.default") {
+		AADInvalidClientCredentialScope.Write(w, request.Scope)
 		return
+	}
 
-	case 401:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(401)
-		json.NewEncoder(w).Encode(map[string]string{
-			"unauthorized": "wrong client id or something on managed identiy endpoint",
-		})
+	// an app-only token belongs to one tenant, which common and organizations do not name
+	if isMultiTenantAuthority(tenantID) {
+		AADNoTenantIdentified.Write(w)
+		return
+	}
 
+	if !validateClientCredential(w, request) {
 		return
+	}
 
-	case 403:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(403)
-		json.NewEncoder(w).Encode(map[string]string{
-			"forbidden": "not allowed on this specific tenant perhaps on managed identiy endpoint",
-		})
+	// Good, generate a fake Bearer for the app and cache it as authorised
+	audience := strings.TrimSuffix(scopes[0], "/.default")
+	token, _ := IssueAppToken(CloudFor(r), tenantID, request.ClientID, audience, "1.0", Now().Unix(), withExpiry)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(OAuthResponse{
+		AccessToken:  token,
+		ExpiresIn:    int32(withExpiry),
+		ExtExpiresIn: int32(withExpiry),
+		TokenType:    "Bearer",
+	})
+}
+
+// OAuthV1TokenPost is the AAD v1 endpoint, which is addressed by `resource` instead of `scope`
+func OAuthV1TokenPost(w http.ResponseWriter, r *http.Request) {
+	tenantID := mux.Vars(r)["tenantId"]
 
+	withExpiry, done := oauthFakeResponse(w, r)
+	if done {
 		return
+	}
 
-	default:
-		if withCode == 0 || withCode == 200 {
-			// Good, generate a fake Bearer and cache it as authorised
-			randToken := RandStringRunes(50)
-			expiresAt := time.Now().Unix() + int64(withExpiry)
-			Tokens[fmt.Sprintf("Bearer %s", randToken)] = expiresAt
-
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(OAuthResponse{
-				AccessToken:  randToken,
-				ExpiresIn:    int32(withExpiry),
-				ExtExpiresIn: int32(withExpiry),
-				TokenType:    "Bearer",
-			})
-		} else {
-			// Nonspecific fake error code
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(withCode)
-			json.NewEncoder(w).Encode(map[string]string{
-				"nonspecific error on managed identiy endpoint": "error",
-			})
-		}
+	request, ok := ParseOAuthRequest(w, r)
+	if !ok || !allowTokenRequest(w, tenantID, request.ClientID) {
+		return
+	}
+
+	if request.GrantType != "client_credentials" {
+		AADUnsupportedGrantType.Write(w, request.GrantType)
+		return
+	}
+
+	resource := request.Resource
+	if resource == "" {
+		AADMissingParameter.Write(w, "resource")
+		return
 	}
+
+	if isMultiTenantAuthority(tenantID) {
+		AADNoTenantIdentified.Write(w)
+		return
+	}
+
+	if !validateClientCredential(w, request) {
+		return
+	}
+
+	clientID := request.ClientID
+	now := Now().Unix()
+	token, expiresAt := IssueAppToken(CloudFor(r), tenantID, clientID, resource, "1.0", now, withExpiry)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(OAuthV1Response{
+		AccessToken:  token,
+		ExpiresIn:    strconv.Itoa(withExpiry),
+		ExpiresOn:    strconv.FormatInt(expiresAt, 10),
+		ExtExpiresIn: strconv.Itoa(withExpiry),
+		NotBefore:    strconv.FormatInt(now, 10),
+		Resource:     resource,
+		TokenType:    "Bearer",
+	})
 }
 
-func OAuthTokenPost(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	_, ok := vars["tenantId"]
-	if !ok {
-		log.Println("tenantId is required in URL ('/{tenantId}/oauth2/v2.0/token')")
-		// do an error
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"generic error": "error",
-		})
+// ParseOAuthRequest reads the form-encoded body of a token request and checks the fields every grant needs.
+// It writes AADSTS900144 and returns false when the body cannot be read or a required field is missing.
+func ParseOAuthRequest(w http.ResponseWriter, r *http.Request) (*OAuthRequest, bool) {
+	if !parseOAuthForm(w, r, "grant_type") {
+		return nil, false
+	}
+
+	request := &OAuthRequest{
+		GrantType:           r.PostForm.Get("grant_type"),
+		ClientID:            r.PostForm.Get("client_id"),
+		ClientSecret:        r.PostForm.Get("client_secret"),
+		ClientAssertion:     r.PostForm.Get("client_assertion"),
+		ClientAssertionType: r.PostForm.Get("client_assertion_type"),
+		Scope:               r.PostForm.Get("scope"),
+		Resource:            r.PostForm.Get("resource"),
+		Claims:              r.PostForm.Get("claims"),
+	}
+
+	if request.GrantType == "" {
+		AADMissingParameter.Write(w, "grant_type")
+		return nil, false
 	}
 
+	if request.ClientID == "" {
+		AADMissingParameter.Write(w, "client_id")
+		return nil, false
+	}
+
+	// a claims challenge is always satisfied, since every token is freshly issued
+	if !validateClaimsParameter(w, request.Claims) {
+		return nil, false
+	}
+
+	return request, true
+}
+
+// parseOAuthForm reads the form body of an AAD endpoint. AAD only reads form bodies, so anything else
+// looks like a request without parameters, and is answered as missing the endpoint's first parameter.
+func parseOAuthForm(w http.ResponseWriter, r *http.Request, firstParameter string) bool {
+	mediaType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	if !strings.EqualFold(mediaType, "application/x-www-form-urlencoded") || r.ParseForm() != nil {
+		AADMissingParameter.Write(w, firstParameter)
+		return false
+	}
+
+	return true
+}
+
+// validateClientCredential checks that a confidential client sent exactly one of a secret or a signed assertion
+func validateClientCredential(w http.ResponseWriter, request *OAuthRequest) bool {
+	switch {
+	case request.ClientSecret == "" && request.ClientAssertion == "":
+		AADMissingClientCredential.Write(w, request.GrantType)
+		return false
+
+	case request.ClientSecret != "" && request.ClientAssertion != "":
+		AADTooManyClientCredentials.Write(w, request.GrantType)
+		return false
+
+	case request.ClientAssertion != "" && request.ClientAssertionType != "urn:ietf:params:oauth:client-assertion-type:jwt-bearer":
+		AADMissingParameter.Write(w, "client_assertion_type")
+		return false
+	}
+
+	return true
+}
+
+// oauthFakeResponse applies the ?withcode= and ?withexpiry= switches shared by the token endpoints,
+// answering with the catalog error for the status. It returns the requested token lifetime, or done
+// when a fake error has already been written.
+func oauthFakeResponse(w http.ResponseWriter, r *http.Request) (int, bool) {
 	// Check if we want a fake error
 	var withCode int = 0
 	var err error
 
-	withCodeRaw := r.URL.Query().Get("withcode")
+	withCodeRaw := FaultSwitch(r, "withcode")
 	if withCodeRaw != "" {
 		withCode, err = strconv.Atoi(withCodeRaw)
 
 		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{
-				"internal server error": "could not parse 'withcode' as an integer",
-			})
+			AADServerError.Write(w)
+			log.Println("could not parse 'withcode' as an integer")
 
-			return
+			return 0, true
 		}
 	}
 
 	var withExpiry int = 30
-	withExpiryRaw := r.URL.Query().Get("withexpiry")
+	withExpiryRaw := FaultSwitch(r, "withexpiry")
 	if withExpiryRaw != "" {
 		withExpiry, err = strconv.Atoi(withExpiryRaw)
 
 		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{
-				"internal server error": "could not parse 'withexpiry' as an integer",
-			})
+			AADServerError.Write(w)
+			log.Println("could not parse 'withexpiry' as an integer")
 
-			return
+			return 0, true
 		}
 	}
 
 	switch withCode {
-	case 500:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"internal server error": "error",
-		})
+	case 0, 200:
+		return withExpiry, false
 
-		return
+	case 400:
+		AADInvalidGrant.Write(w)
 
 	case 401:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(401)
-		json.NewEncoder(w).Encode(map[string]string{
-			"unauthorized": "wrong client id or something",
-		})
-
-		return
+		AADInvalidClientSecret.Write(w, r.FormValue("client_id"))
 
 	case 403:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(403)
-		json.NewEncoder(w).Encode(map[string]string{
-			"forbidden": "not allowed on this specific tenant perhaps",
-		})
+		AADAccessBlocked.Write(w)
 
-		return
+	case 429:
+		w.Header().Set("Retry-After", strconv.Itoa(throttlingWindow))
+		AADRequestLoop.Write(w)
+
+	case 503:
+		AADTransientError.Write(w)
 
 	default:
-		if withCode == 0 || withCode == 200 {
-			// Good, generate a fake Bearer and cache it as authorised
-			randToken := RandStringRunes(50)
-			expiresAt := time.Now().Unix() + int64(withExpiry)
-			Tokens[fmt.Sprintf("Bearer %s", randToken)] = expiresAt
-
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(OAuthResponse{
-				AccessToken:  randToken,
-				ExpiresIn:    int32(withExpiry),
-				ExtExpiresIn: int32(withExpiry),
-				TokenType:    "Bearer",
-			})
-		} else {
-			// Nonspecific fake error code
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(withCode)
-			json.NewEncoder(w).Encode(map[string]string{
-				"nonspecific error": "error",
-			})
+		// other statuses get an invalid grant, or a server error from 500 up
+		catalogued := AADInvalidGrant
+		if withCode >= 500 {
+			catalogued = AADServerError
 		}
+		catalogued.Status = withCode
+		catalogued.Write(w)
 	}
+
+	return 0, true
 }
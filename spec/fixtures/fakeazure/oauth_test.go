@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// accessTokenClaims reads the claims of the access_token in a token response
+func accessTokenClaims(t *testing.T, body map[string]interface{}) Claims {
+	t.Helper()
+
+	token, _ := body["access_token"].(string)
+	claims, err := ParseToken(token)
+	if err != nil {
+		t.Fatalf("access_token is not a fakeazure token: %s", err)
+	}
+
+	return claims
+}
+
+func TestOAuthV1TokenPost(t *testing.T) {
+	withDefaultConfig(t)
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {"fake_client"},
+		"client_secret": {"fake_secret"},
+		"resource":      {"https://vault.azure.net"},
+	}
+
+	recorder := postForm("/fake_tenant/oauth2/token?withexpiry=60", form)
+	expectStatus(t, recorder, http.StatusOK)
+
+	body := decodeBody(t, recorder)
+	if body["expires_in"] != "60" || body["resource"] != "https://vault.azure.net" {
+		t.Fatalf("v1 response does not use strings or echo the resource: %v", body)
+	}
+	for _, field := range []string{"expires_on", "ext_expires_in", "not_before"} {
+		if _, ok := body[field].(string); !ok {
+			t.Fatalf("%s is not a string: %v", field, body[field])
+		}
+	}
+
+	if claims := accessTokenClaims(t, body); claims.String("aud") != "https://vault.azure.net" || claims.String("ver") != "1.0" {
+		t.Fatalf("token is not a v1 token for the resource: %v", claims)
+	}
+
+	form.Del("resource")
+	recorder = postForm("/fake_tenant/oauth2/token", form)
+	expectStatus(t, recorder, http.StatusBadRequest)
+	if body := decodeBody(t, recorder); body["error"] != "invalid_request" {
+		t.Fatalf("missing resource was not an invalid_request: %v", body)
+	}
+}
+
+func TestClientCredentialsStayInTheirTenant(t *testing.T) {
+	withDefaultConfig(t)
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {"fake_client"},
+		"client_secret": {"fake_secret"},
+		"scope":         {"https://vault.azure.net/.default"},
+	}
+
+	for _, tenantID := range []string{"common", "organizations", "consumers"} {
+		recorder := postForm("/"+tenantID+"/oauth2/v2.0/token", form)
+		expectStatus(t, recorder, http.StatusBadRequest)
+		expectAADError(t, recorder, 50059)
+	}
+
+	v1Form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {"fake_client"},
+		"client_secret": {"fake_secret"},
+		"resource":      {"https://vault.azure.net"},
+	}
+	recorder := postForm("/common/oauth2/token", v1Form)
+	expectStatus(t, recorder, http.StatusBadRequest)
+	expectAADError(t, recorder, 50059)
+
+	// jack-vault belongs to fake_tenant, so a token of another tenant is refused before any role is checked
+	recorder = postForm("/other_tenant/oauth2/v2.0/token", form)
+	expectStatus(t, recorder, http.StatusOK)
+	token := decodeBody(t, recorder)["access_token"].(string)
+
+	recorder = serve(http.MethodGet, "/keyvault/jack-vault/secrets/demo?api-version=7.4", "", map[string]string{"Authorization": "Bearer " + token})
+	expectStatus(t, recorder, http.StatusUnauthorized)
+	if !strings.Contains(recorder.Body.String(), "AKV10032: Invalid issuer") {
+		t.Fatalf("token of another tenant was not refused with AKV10032: %s", recorder.Body.String())
+	}
+}
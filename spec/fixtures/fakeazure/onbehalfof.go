@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const jwtBearerGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// oauthOnBehalfOfGrant swaps a user's token, issued to the calling app, for a token to a downstream
+// resource that still carries the user's identity
+func oauthOnBehalfOfGrant(w http.ResponseWriter, r *http.Request, tenantID string, lifetime int) {
+	if r.PostForm.Get("requested_token_use") != "on_behalf_of" {
+		AADMissingParameter.Write(w, "requested_token_use")
+		return
+	}
+
+	assertion := r.PostForm.Get("assertion")
+	if assertion == "" {
+		AADMissingParameter.Write(w, "assertion")
+		return
+	}
+
+	clientID := r.PostForm.Get("client_id")
+	if clientID == "" {
+		AADMissingParameter.Write(w, "client_id")
+		return
+	}
+
+	scopes := strings.Fields(r.PostForm.Get("scope"))
+	if len(scopes) == 0 {
+		AADMissingParameter.Write(w, "scope")
+		return
+	}
+
+	claims, err := ParseToken(assertion)
+	if err != nil {
+		AADMalformedToken.Write(w)
+		return
+	}
+
+	now := Now().Unix()
+
+	switch audience := claims.String("aud"); {
+	case claims.String("idtyp") != "user" || claims.String("oid") == "":
+		AADAssertionNotUserToken.Write(w)
+		return
+
+	case now < claims.Int64("nbf") || now > claims.Int64("exp"):
+		AADAssertionExpired.Write(w)
+		return
+
+	case audience != clientID && audience != "api://"+clientID:
+		AADAssertionAudienceMismatch.Write(w, audience, clientID)
+		return
+
+	case claims.String("tid") != tenantID || !CloudFor(r).IssuerAccepted(claims.String("iss"), tenantID):
+		AADAssertionInvalidIssuer.Write(w, tenantID)
+		return
+	}
+
+	// only tokens fakeazure issued and has not revoked can be exchanged
+	issued, ok := Tokens.Lookup("Bearer " + assertion)
+	switch {
+	case !ok:
+		AADInvalidGrant.Write(w)
+		return
+
+	case issued.Revoked():
+		AADGrantRevoked.Write(w)
+		return
+	}
+
+	// the user may come from another flow, or from a tenant we were not configured with
+	user := FindUser(claims.String("oid"))
+	if user == nil {
+		user = &TestUser{
+			UPN:      claims.String("upn"),
+			ObjectID: claims.String("oid"),
+			Name:     claims.String("name"),
+			TenantID: tenantID,
+		}
+	}
+
+	writeDelegatedTokens(w, CloudFor(r), clientID, tenantID, user, scopes, "", lifetime)
+}
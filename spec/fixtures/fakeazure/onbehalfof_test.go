@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// userAssertion is a token the default user got for a front-end app, to call the API of `audience`
+func userAssertion(audience string) string {
+	token, _ := IssueUserToken(DefaultCloud(), "fake_tenant", "front_end", Config.Users[0], []string{audience + "/access_as_user"}, Now().Unix(), 3600)
+	return token
+}
+
+// onBehalfOf is fake_client exchanging an assertion for a Key Vault token
+func onBehalfOf(assertion string) url.Values {
+	return url.Values{
+		"grant_type":          {jwtBearerGrantType},
+		"requested_token_use": {"on_behalf_of"},
+		"client_id":           {"fake_client"},
+		"client_secret":       {"fake_secret"},
+		"assertion":           {assertion},
+		"scope":               {"https://vault.azure.net/.default"},
+	}
+}
+
+func TestOnBehalfOfGrant(t *testing.T) {
+	withDefaultConfig(t)
+
+	recorder := postForm("/fake_tenant/oauth2/v2.0/token", onBehalfOf(userAssertion("api://fake_client")))
+	expectStatus(t, recorder, http.StatusOK)
+
+	claims := accessTokenClaims(t, decodeBody(t, recorder))
+	if claims.String("aud") != "https://vault.azure.net" || claims.String("oid") != Config.Users[0].ObjectID || claims.String("upn") != Config.Users[0].UPN {
+		t.Fatalf("downstream token is not the user's token to Key Vault: %v", claims)
+	}
+
+	// only a confidential client may exchange a token
+	form := onBehalfOf(userAssertion("api://fake_client"))
+	form.Del("client_secret")
+	recorder = postForm("/fake_tenant/oauth2/v2.0/token", form)
+	expectStatus(t, recorder, http.StatusUnauthorized)
+	expectAADError(t, recorder, 7000216)
+}
+
+func TestOnBehalfOfGrantRefusesAssertions(t *testing.T) {
+	withDefaultConfig(t)
+
+	revoked := userAssertion("api://fake_client")
+	Tokens.Revoke(revoked, Now().Unix())
+
+	appOnly, _ := IssueAppToken(DefaultCloud(), "fake_tenant", "front_end", "api://fake_client", "1.0", Now().Unix(), 3600)
+
+	// a well-formed user token that fakeazure never handed out
+	forged, _ := ParseToken(userAssertion("api://fake_client"))
+	forged["uti"] = RandStringRunes(22)
+
+	tests := []struct {
+		name      string
+		assertion string
+		code      int
+	}{
+		{"issued to another app", userAssertion("api://another_app"), 50013},
+		{"app-only", appOnly, 50013},
+		{"revoked", revoked, 50173},
+		{"never issued", MintToken(forged), 70000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := postForm("/fake_tenant/oauth2/v2.0/token", onBehalfOf(test.assertion))
+			expectStatus(t, recorder, http.StatusBadRequest)
+			expectAADError(t, recorder, test.code)
+		})
+	}
+}
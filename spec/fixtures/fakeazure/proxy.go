@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The proxy modes. With neither, fakeazure answers everything itself.
+const (
+	// forward to the upstreams and save each exchange as a cassette
+	RecordMode = "record"
+	// answer from the cassettes, falling back to fakeazure's own handlers
+	ReplayMode = "replay"
+)
+
+// ProxyConfig sets up recording real Azure answers, and replaying them offline
+type ProxyConfig struct {
+	Mode        string      `json:"mode"`
+	CassetteDir string      `json:"cassette_dir"`
+	Upstreams   []*Upstream `json:"upstreams"`
+	// the query parameters a cassette is matched on, all of them when empty
+	MatchQuery []string `json:"match_query"`
+	// JSON fields redacted from bodies on top of the credentials and Key Vault material
+	RedactFields []string `json:"redact_fields"`
+}
+
+// Upstream is where requests under a path prefix are forwarded to when recording. The prefix is
+// replaced by the URL, so `/keyvault/jack-vault/secrets/demo` under `/keyvault/jack-vault` goes
+// to `https://jack.vault.azure.net/secrets/demo`.
+type Upstream struct {
+	PathPrefix string `json:"path_prefix"`
+	URL        string `json:"url"`
+}
+
+// Cassette is a recorded exchange. Bodies are kept as JSON when they are JSON, for editing by hand.
+type Cassette struct {
+	Request    CassetteRequest  `json:"request"`
+	Response   CassetteResponse `json:"response"`
+	RecordedAt string           `json:"recorded_at"`
+}
+
+type CassetteRequest struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Query  url.Values  `json:"query"`
+	Body   interface{} `json:"body,omitempty"`
+}
+
+type CassetteResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    interface{}       `json:"body,omitempty"`
+}
+
+const defaultCassetteDir = "cassettes"
+
+const redacted = "REDACTED"
+
+// the credentials that never make it into a cassette
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Identity-Header"}
+var redactedParameters = []string{"client_secret", "client_assertion", "assertion", "refresh_token", "code", "code_verifier", "device_code", "password"}
+var redactedFields = []string{"access_token", "refresh_token", "id_token", "client_secret"}
+
+// the Key Vault material never recorded: secret values, which include the private key of a
+// certificate's secret bundle, imported certificates and the private parts of JSON web keys
+var redactedKeyVaultFields = map[string][]string{
+	"/secrets/":        {"value"},
+	"/deletedsecrets/": {"value"},
+	"/certificates/":   {"value", "pwd"},
+	"/keys/":           {"d", "p", "q", "dp", "dq", "qi", "k"},
+	"/deletedkeys/":    {"d", "p", "q", "dp", "dq", "qi", "k"},
+}
+
+// headers that describe the connection or the encoding of the recorded body, not the answer
+var unrecordedHeaders = []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Content-Length", "Content-Encoding", "Date"}
+
+var proxyClient = &http.Client{Timeout: 30 * time.Second}
+
+var unsafeFilenameRunes = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// RecordReplay answers from, or records to, the cassettes ahead of the router. The admin API is
+// never proxied.
+func RecordReplay(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		configLock.Lock()
+		proxy := Config.Proxy
+		configLock.Unlock()
+
+		if proxy.Mode == "" || strings.HasPrefix(r.URL.Path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch proxy.Mode {
+		case ReplayMode:
+			if !replay(w, r, &proxy) {
+				next.ServeHTTP(w, r)
+			}
+
+		case RecordMode:
+			upstream := proxy.upstreamFor(r.URL.Path)
+			if upstream == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			record(w, r, &proxy, upstream)
+		}
+	})
+}
+
+func (p *ProxyConfig) upstreamFor(path string) *Upstream {
+	for _, upstream := range p.Upstreams {
+		if strings.HasPrefix(path, upstream.PathPrefix) {
+			return upstream
+		}
+	}
+
+	return nil
+}
+
+// matchedQuery is the part of a query a cassette is matched on, with the credentials redacted so
+// that it can be compared with the query a cassette holds
+func (p *ProxyConfig) matchedQuery(query url.Values) url.Values {
+	matched := url.Values{}
+	for name, values := range redactValues(query) {
+		if len(p.MatchQuery) == 0 || containsFold(p.MatchQuery, name) {
+			matched[name] = values
+		}
+	}
+
+	return matched
+}
+
+// cassettePath names a cassette after what it is matched on: the method, the path and the
+// matched query parameters
+func (p *ProxyConfig) cassettePath(method string, path string, query url.Values) string {
+	// Encode sorts by name
+	key := strings.ToUpper(method) + " " + path + "?" + p.matchedQuery(query).Encode()
+	sum := sha1.Sum([]byte(key))
+	readable := strings.Trim(unsafeFilenameRunes.ReplaceAllString(path, "_"), "_")
+
+	return filepath.Join(p.CassetteDir, fmt.Sprintf("%s_%s_%x.json", strings.ToUpper(method), readable, sum[:6]))
+}
+
+func replay(w http.ResponseWriter, r *http.Request, p *ProxyConfig) bool {
+	path := p.cassettePath(r.Method, r.URL.Path, r.URL.Query())
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("no cassette for %s %s, answering it as fakeazure\n", r.Method, r.URL.Path)
+		return false
+	}
+
+	var cassette Cassette
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&cassette); err != nil {
+		log.Printf("could not parse cassette %s: %s\n", path, err)
+		return false
+	}
+
+	// the file name only narrows the search down, the request in the cassette has the last word,
+	// so that cassettes edited or written by hand are matched on what they hold
+	if !strings.EqualFold(cassette.Request.Method, r.Method) || cassette.Request.Path != r.URL.Path ||
+		p.matchedQuery(cassette.Request.Query).Encode() != p.matchedQuery(r.URL.Query()).Encode() {
+		log.Printf("cassette %s was recorded for another request than %s %s, answering it as fakeazure\n", path, r.Method, r.URL.Path)
+		return false
+	}
+
+	for name, value := range cassette.Response.Headers {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(cassette.Response.Status)
+
+	switch body := cassette.Response.Body.(type) {
+	case nil:
+	case string:
+		w.Write([]byte(body))
+	default:
+		json.NewEncoder(w).Encode(body)
+	}
+
+	return true
+}
+
+func record(w http.ResponseWriter, r *http.Request, p *ProxyConfig, upstream *Upstream) {
+	requestBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeAdminError(w, http.StatusBadGateway, "could not read the request to forward: "+err.Error())
+		return
+	}
+
+	target := strings.TrimSuffix(upstream.URL, "/") + "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, upstream.PathPrefix), "/")
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+
+	forwarded, err := http.NewRequest(r.Method, target, bytes.NewReader(requestBody))
+	if err != nil {
+		writeAdminError(w, http.StatusBadGateway, "could not forward to "+upstream.URL+": "+err.Error())
+		return
+	}
+	forwarded.Header = r.Header.Clone()
+	// let the transport negotiate, and undo, compression
+	forwarded.Header.Del("Accept-Encoding")
+
+	response, err := proxyClient.Do(forwarded)
+	if err != nil {
+		writeAdminError(w, http.StatusBadGateway, "could not forward to "+upstream.URL+": "+err.Error())
+		return
+	}
+	defer response.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		writeAdminError(w, http.StatusBadGateway, "could not read the answer of "+upstream.URL+": "+err.Error())
+		return
+	}
+
+	cassette := &Cassette{
+		Request: CassetteRequest{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  redactValues(r.URL.Query()),
+			Body:   p.redactBody(requestBody, r.Header.Get("Content-Type"), r.URL.Path),
+		},
+		Response: CassetteResponse{
+			Status:  response.StatusCode,
+			Headers: map[string]string{},
+			Body:    p.redactBody(responseBody, response.Header.Get("Content-Type"), r.URL.Path),
+		},
+		RecordedAt: Now().UTC().Format(time.RFC3339),
+	}
+
+	for name, values := range response.Header {
+		if containsFold(unrecordedHeaders, name) {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+
+		cassette.Response.Headers[name] = response.Header.Get(name)
+		if containsFold(redactedHeaders, name) {
+			cassette.Response.Headers[name] = redacted
+		}
+	}
+	w.WriteHeader(response.StatusCode)
+	w.Write(responseBody)
+
+	path := p.cassettePath(r.Method, r.URL.Path, r.URL.Query())
+	if err := saveCassette(path, cassette); err != nil {
+		log.Printf("could not save cassette %s: %s\n", path, err)
+		return
+	}
+	log.Printf("recorded %s %s to %s\n", r.Method, r.URL.Path, path)
+}
+
+func saveCassette(path string, cassette *Cassette) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	encoded, err := json.MarshalIndent(cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(encoded, '\n'), 0644)
+}
+
+// redactBody keeps a body as JSON, or form values, with the credentials and the Key Vault material
+// of the path replaced, and as a string otherwise
+func (p *ProxyConfig) redactBody(body []byte, contentType string, path string) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == "application/x-www-form-urlencoded" {
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			return redactValues(values).Encode()
+		}
+	}
+
+	var parsed interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&parsed); err == nil {
+		return redactJSON(parsed, p.redactedFieldsFor(path))
+	}
+
+	return string(body)
+}
+
+func (p *ProxyConfig) redactedFieldsFor(path string) []string {
+	fields := append(append([]string{}, redactedFields...), p.RedactFields...)
+
+	lowered := strings.ToLower(path)
+	for segment, keyVaultFields := range redactedKeyVaultFields {
+		if strings.Contains(lowered, segment) {
+			fields = append(fields, keyVaultFields...)
+		}
+	}
+
+	return fields
+}
+
+// redactJSON replaces the named fields wherever they hold a plain value. Objects and arrays are
+// searched instead, so that the `value` list of a secrets listing is kept.
+func redactJSON(value interface{}, fields []string) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, field := range value {
+			switch field.(type) {
+			case map[string]interface{}, []interface{}:
+				value[name] = redactJSON(field, fields)
+			default:
+				if containsFold(fields, name) {
+					value[name] = redacted
+				}
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactJSON(item, fields)
+		}
+	}
+
+	return value
+}
+
+func redactValues(values url.Values) url.Values {
+	kept := url.Values{}
+	for name, value := range values {
+		if containsFold(redactedParameters, name) {
+			kept[name] = []string{redacted}
+		} else {
+			kept[name] = value
+		}
+	}
+
+	return kept
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func AdminProxyGet(w http.ResponseWriter, r *http.Request) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Config.Proxy)
+}
+
+// AdminProxyPut switches between recording, replaying and answering as fakeazure
+func AdminProxyPut(w http.ResponseWriter, r *http.Request) {
+	var proxy ProxyConfig
+	if err := json.NewDecoder(r.Body).Decode(&proxy); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "could not parse proxy settings: "+err.Error())
+		return
+	}
+
+	if err := proxy.validate(); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if proxy.CassetteDir == "" {
+		proxy.CassetteDir = defaultCassetteDir
+	}
+
+	configLock.Lock()
+	Config.Proxy = proxy
+	configLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(proxy)
+}
+
+func (p *ProxyConfig) validate() error {
+	switch p.Mode {
+	case "", RecordMode, ReplayMode:
+	default:
+		return errors.New("mode must be record, replay or empty")
+	}
+
+	for _, upstream := range p.Upstreams {
+		parsed, err := url.Parse(upstream.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("upstream for %s needs an http or https url", upstream.PathPrefix)
+		}
+	}
+
+	return nil
+}
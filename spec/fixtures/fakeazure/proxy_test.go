@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useProxy switches the proxy settings through the admin API, as a test run would
+func useProxy(t *testing.T, proxy string) {
+	t.Helper()
+
+	expectStatus(t, serve(http.MethodPut, "/admin/proxy", proxy, nil), http.StatusOK)
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	withDefaultConfig(t)
+
+	var forwarded url.Values
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		forwarded = r.PostForm
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(`{"access_token": "upstream-token", "token_type": "Bearer", "expires_in": 3599}`))
+	}))
+	defer upstream.Close()
+
+	cassettes := t.TempDir()
+	useProxy(t, `{"mode": "record", "cassette_dir": "`+cassettes+`", "upstreams": [{"path_prefix": "/upstream_tenant", "url": "`+upstream.URL+`/upstream_tenant"}], "match_query": ["api-version"]}`)
+
+	const target = "/upstream_tenant/oauth2/v2.0/token?api-version=2.0"
+	form := "grant_type=client_credentials&client_id=fake_client&client_secret=real_secret"
+
+	// media types are case-insensitive, so this form is still redacted
+	recorder := serve(http.MethodPost, target, form, map[string]string{"Content-Type": "Application/X-WWW-Form-Urlencoded; charset=UTF-8"})
+	expectStatus(t, recorder, http.StatusOK)
+	if decodeBody(t, recorder)["access_token"] != "upstream-token" || forwarded.Get("client_secret") != "real_secret" {
+		t.Fatalf("request was not forwarded as is: %s, upstream got %v", recorder.Body.String(), forwarded)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(cassettes, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("recorded %d cassettes, want 1", len(files))
+	}
+	raw, _ := ioutil.ReadFile(files[0])
+	if strings.Contains(string(raw), "real_secret") || strings.Contains(string(raw), "upstream-token") {
+		t.Fatalf("cassette holds credentials: %s", raw)
+	}
+
+	upstream.Close()
+	useProxy(t, `{"mode": "replay", "cassette_dir": "`+cassettes+`", "match_query": ["api-version"]}`)
+
+	recorder = serve(http.MethodPost, target+"&unmatched=1", form, map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+	expectStatus(t, recorder, http.StatusOK)
+	if body := decodeBody(t, recorder); body["access_token"] != redacted || body["expires_in"] != float64(3599) {
+		t.Fatalf("answer was not replayed from the cassette: %v", body)
+	}
+
+	// another matched query parameter has no cassette, so fakeazure answers itself
+	recorder = serve(http.MethodPost, "/upstream_tenant/oauth2/v2.0/token?api-version=1.0", form, map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+	if body := recorder.Body.String(); strings.Contains(body, redacted) {
+		t.Fatalf("cassette of api-version 2.0 was replayed for 1.0: %s", body)
+	}
+
+	// a cassette edited to another query no longer answers under its old name
+	var cassette Cassette
+	json.Unmarshal(raw, &cassette)
+	cassette.Request.Query.Set("api-version", "3.0")
+	saveCassette(files[0], &cassette)
+
+	recorder = serve(http.MethodPost, target, form, map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+	if body := recorder.Body.String(); strings.Contains(body, redacted) {
+		t.Fatalf("cassette was replayed for a query it does not hold: %s", body)
+	}
+}
+
+func TestProxyUpstreamNeedsHTTPURL(t *testing.T) {
+	withDefaultConfig(t)
+
+	for _, upstreamURL := range []string{"", "jack-vault.vault.azure.net", "ftp://jack-vault.vault.azure.net", "https://"} {
+		recorder := serve(http.MethodPut, "/admin/proxy", `{"mode": "record", "upstreams": [{"path_prefix": "/keyvault", "url": "`+upstreamURL+`"}]}`, nil)
+		expectStatus(t, recorder, http.StatusBadRequest)
+	}
+
+	useProxy(t, `{"mode": "record", "upstreams": [{"path_prefix": "/keyvault", "url": "HTTPS://jack-vault.vault.azure.net"}]}`)
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Key Vault data actions checked by the handlers
+const (
+	SecretGetAction       = "Microsoft.KeyVault/vaults/secrets/getSecret/action"
+	SecretDeleteAction    = "Microsoft.KeyVault/vaults/secrets/delete"
+	KeyReadAction         = "Microsoft.KeyVault/vaults/keys/read"
+	CertificateReadAction = "Microsoft.KeyVault/vaults/certificates/read"
+)
+
+// RoleDefinition follows the ARM role definition schema. Actions and NotActions govern the management plane,
+// DataActions and NotDataActions the data plane. Each Not* list only subtracts from its own role.
+type RoleDefinition struct {
+	ID               string   `json:"id"`
+	RoleName         string   `json:"roleName"`
+	Type             string   `json:"type"`
+	Actions          []string `json:"actions"`
+	NotActions       []string `json:"notActions"`
+	DataActions      []string `json:"dataActions"`
+	NotDataActions   []string `json:"notDataActions"`
+	AssignableScopes []string `json:"assignableScopes"`
+}
+
+// ManagementGroup places subscriptions, and other groups, under a parent. Groups without a parent,
+// and subscriptions in no group, sit under the tenant root group, which is named after the tenant ID.
+type ManagementGroup struct {
+	Name          string   `json:"name"`
+	Parent        string   `json:"parent"`
+	Subscriptions []string `json:"subscriptions"`
+}
+
+// RoleAssignment binds a principal to a role at a scope, and to everything below that scope.
+// RoleDefinitionID takes either the role's GUID or its name.
+type RoleAssignment struct {
+	ID               string `json:"id"`
+	PrincipalID      string `json:"principal_id"`
+	RoleDefinitionID string `json:"role_definition_id"`
+	Scope            string `json:"scope"`
+}
+
+var keyVaultManagementReadActions = []string{
+	"Microsoft.Authorization/*/read",
+	"Microsoft.Insights/alertRules/*",
+	"Microsoft.Resources/deployments/*",
+	"Microsoft.Resources/subscriptions/resourceGroups/read",
+	"Microsoft.Support/*",
+	"Microsoft.KeyVault/checkNameAvailability/read",
+	"Microsoft.KeyVault/deletedVaults/read",
+	"Microsoft.KeyVault/locations/*/read",
+	"Microsoft.KeyVault/vaults/*/read",
+	"Microsoft.KeyVault/operations/read",
+}
+
+// BuiltInRoles are the Key Vault data-plane roles, with the IDs and permissions Azure ships
+var BuiltInRoles = []*RoleDefinition{
+	{
+		ID:          "00482a5a-887f-4fb3-b363-3b7fe8e74483",
+		RoleName:    "Key Vault Administrator",
+		Actions:     keyVaultManagementReadActions,
+		DataActions: []string{"Microsoft.KeyVault/vaults/*"},
+	},
+	{
+		ID:          "21090545-7ca7-4776-b22c-e363652d74d2",
+		RoleName:    "Key Vault Reader",
+		Actions:     keyVaultManagementReadActions,
+		DataActions: []string{"Microsoft.KeyVault/vaults/*/read", "Microsoft.KeyVault/vaults/secrets/readMetadata/action"},
+	},
+	{
+		ID:          "4633458b-17de-408a-b874-0445c86b69e6",
+		RoleName:    "Key Vault Secrets User",
+		DataActions: []string{"Microsoft.KeyVault/vaults/secrets/getSecret/action", "Microsoft.KeyVault/vaults/secrets/readMetadata/action"},
+	},
+	{
+		ID:          "b86a8fe4-44ce-4948-aee5-eccb2c155cd7",
+		RoleName:    "Key Vault Secrets Officer",
+		Actions:     keyVaultManagementReadActions,
+		DataActions: []string{"Microsoft.KeyVault/vaults/secrets/*"},
+	},
+	{
+		ID:       "12338af0-0e69-4776-bea7-57ae8d297424",
+		RoleName: "Key Vault Crypto User",
+		DataActions: []string{
+			"Microsoft.KeyVault/vaults/keys/read",
+			"Microsoft.KeyVault/vaults/keys/update/action",
+			"Microsoft.KeyVault/vaults/keys/backup/action",
+			"Microsoft.KeyVault/vaults/keys/encrypt/action",
+			"Microsoft.KeyVault/vaults/keys/decrypt/action",
+			"Microsoft.KeyVault/vaults/keys/wrap/action",
+			"Microsoft.KeyVault/vaults/keys/unwrap/action",
+			"Microsoft.KeyVault/vaults/keys/sign/action",
+			"Microsoft.KeyVault/vaults/keys/verify/action",
+		},
+	},
+	{
+		ID:          "14b46e9e-c2b7-41b4-b07b-48a6ebf60603",
+		RoleName:    "Key Vault Crypto Officer",
+		Actions:     keyVaultManagementReadActions,
+		DataActions: []string{"Microsoft.KeyVault/vaults/keys/*", "Microsoft.KeyVault/vaults/keyrotationpolicies/*"},
+	},
+	{
+		ID:       "db79e9a7-68ee-4b58-9aeb-b90e7c24fcba",
+		RoleName: "Key Vault Certificate User",
+		DataActions: []string{
+			"Microsoft.KeyVault/vaults/certificates/read",
+			"Microsoft.KeyVault/vaults/secrets/getSecret/action",
+			"Microsoft.KeyVault/vaults/secrets/readMetadata/action",
+			"Microsoft.KeyVault/vaults/keys/read",
+		},
+	},
+	{
+		ID:          "a4417e6f-fecd-4de8-b567-7b0420556985",
+		RoleName:    "Key Vault Certificates Officer",
+		Actions:     keyVaultManagementReadActions,
+		DataActions: []string{"Microsoft.KeyVault/vaults/certificatecas/*", "Microsoft.KeyVault/vaults/certificates/*", "Microsoft.KeyVault/vaults/certificatecontacts/write"},
+	},
+}
+
+func init() {
+	for _, role := range BuiltInRoles {
+		role.Type = "BuiltInRole"
+		role.AssignableScopes = []string{"/"}
+	}
+}
+
+// FindRoleDefinition resolves a role by GUID, full definition ID, or name. Callers hold configLock.
+func FindRoleDefinition(id string) *RoleDefinition {
+	id = id[strings.LastIndex(id, "/")+1:]
+
+	for _, role := range append(BuiltInRoles, Config.RoleDefinitions...) {
+		if strings.EqualFold(role.ID, id) || strings.EqualFold(role.RoleName, id) {
+			return role
+		}
+	}
+
+	return nil
+}
+
+func matchAny(patterns []string, action string) bool {
+	for _, pattern := range patterns {
+		if matchAction(pattern, action) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allows evaluates the role on its own: granted by Actions (DataActions) and not taken away by NotActions (NotDataActions)
+func (role *RoleDefinition) Allows(action string, dataAction bool) bool {
+	if dataAction {
+		return matchAny(role.DataActions, action) && !matchAny(role.NotDataActions, action)
+	}
+
+	return matchAny(role.Actions, action) && !matchAny(role.NotActions, action)
+}
+
+// matchAction compares an action against a pattern where `*` matches any run of characters.
+// Like Azure, the comparison ignores case.
+func matchAction(pattern string, action string) bool {
+	pattern, action = strings.ToLower(pattern), strings.ToLower(action)
+
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == action
+	}
+
+	if !strings.HasPrefix(action, parts[0]) {
+		return false
+	}
+	action = action[len(parts[0]):]
+
+	for _, part := range parts[1 : len(parts)-1] {
+		index := strings.Index(action, part)
+		if index < 0 {
+			return false
+		}
+		action = action[index+len(part):]
+	}
+
+	return strings.HasSuffix(action, parts[len(parts)-1])
+}
+
+const managementGroupScopePrefix = "/providers/microsoft.management/managementgroups/"
+
+// scopeCovers says whether an assignment at scope applies to the resource, i.e. the scope is the resource or one of its parents.
+// Callers hold configLock.
+func scopeCovers(scope string, resourceID string) bool {
+	scope = strings.TrimSuffix(strings.ToLower(scope), "/")
+	resourceID = strings.ToLower(resourceID)
+
+	if strings.HasPrefix(scope, managementGroupScopePrefix) {
+		if strings.HasPrefix(resourceID, managementGroupScopePrefix) {
+			return managementGroupWithin(resourceID[len(managementGroupScopePrefix):], scope[len(managementGroupScopePrefix):])
+		}
+
+		return subscriptionWithin(subscriptionOf(resourceID), scope[len(managementGroupScopePrefix):])
+	}
+
+	return scope == "" || resourceID == scope || strings.HasPrefix(resourceID, scope+"/")
+}
+
+func subscriptionOf(resourceID string) string {
+	parts := strings.Split(strings.TrimPrefix(resourceID, "/"), "/")
+	if len(parts) >= 2 && parts[0] == "subscriptions" {
+		return parts[1]
+	}
+
+	return ""
+}
+
+// subscriptionWithin walks up from the subscription's management group looking for the named group
+func subscriptionWithin(subscriptionID string, group string) bool {
+	if subscriptionID == "" {
+		return false
+	}
+
+	for _, mg := range Config.ManagementGroups {
+		for _, member := range mg.Subscriptions {
+			if strings.EqualFold(member, subscriptionID) {
+				return managementGroupWithin(mg.Name, group)
+			}
+		}
+	}
+
+	return strings.EqualFold(group, Config.DefaultTenantID)
+}
+
+func managementGroupWithin(name string, group string) bool {
+	// bounded, so a cycle in the configured hierarchy cannot hang a request
+	for depth := 0; name != "" && depth <= len(Config.ManagementGroups); depth++ {
+		if strings.EqualFold(name, group) {
+			return true
+		}
+
+		parent := ""
+		for _, mg := range Config.ManagementGroups {
+			if strings.EqualFold(mg.Name, name) {
+				parent = mg.Parent
+			}
+		}
+		name = parent
+	}
+
+	return strings.EqualFold(group, Config.DefaultTenantID)
+}
+
+// CheckAccess says whether any role assigned to the principal, at or above the resource, grants the action.
+// As in Azure, permissions are the union over all applicable roles.
+func CheckAccess(principalID string, resourceID string, action string, dataAction bool) bool {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	for _, assignment := range Config.RoleAssignments {
+		if assignment.PrincipalID != principalID || !scopeCovers(assignment.Scope, resourceID) {
+			continue
+		}
+
+		role := FindRoleDefinition(assignment.RoleDefinitionID)
+		if role != nil && role.Allows(action, dataAction) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func CheckDataAction(principalID string, resourceID string, action string) bool {
+	return CheckAccess(principalID, resourceID, action, true)
+}
+
+// AuthorizeKeyVault checks that the caller's token is meant for Key Vault in this cloud and comes from
+// the vault's tenant, then checks it against the vault's role assignments, or its access policies.
+// When the token is refused it writes Azure's 401, when the action is denied Azure's 403, and returns false.
+func AuthorizeKeyVault(w http.ResponseWriter, r *http.Request, vaultName string, collection string, objectName string, action string) bool {
+	claims, err := ParseToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if err != nil {
+		// tokens that are not ours were already turned away by the Tokens lookup
+		claims = Claims{}
+	}
+
+	cloud := CloudFor(r)
+	if !cloud.AudienceAccepted(claims.String("aud")) {
+		SetKeyVaultChallenge(w, r, vaultName)
+		KeyVaultUnauthorized.Write(w, fmt.Sprintf("AKV10022: Invalid audience. Expected %s, found: %s.", cloud.KeyVaultAudience, claims.String("aud")))
+
+		return false
+	}
+
+	vault := FindVault(vaultName)
+	if claims.String("tid") != vault.TenantFor() || !cloud.IssuerAccepted(claims.String("iss"), vault.TenantFor()) {
+		SetKeyVaultChallenge(w, r, vaultName)
+		KeyVaultUnauthorized.Write(w, fmt.Sprintf("AKV10032: Invalid issuer. Expected one of %s, %s, found %s.",
+			cloud.Issuer(vault.TenantFor(), "1.0"), cloud.Issuer(vault.TenantFor(), "2.0"), claims.String("iss")))
+
+		return false
+	}
+
+	if !vault.RbacEnabled() {
+		return authorizeAccessPolicy(w, claims, vault, collection, action)
+	}
+
+	resourceID := vault.ResourceID() + "/" + collection + "/" + objectName
+
+	if CheckDataAction(claims.String("oid"), resourceID, action) {
+		return true
+	}
+
+	KeyVaultForbiddenByRbac.Write(w,
+		claims.String("appid"), claims.String("oid"), claims.String("iss"), action, strings.ToLower(resourceID), vault.Name, vault.Location)
+
+	return false
+}
+
+func AdminRoleAssignmentsGet(w http.ResponseWriter, r *http.Request) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"value": Config.RoleAssignments,
+	})
+}
+
+// AdminRoleAssignmentPut creates or replaces the role assignment named in the path
+func AdminRoleAssignmentPut(w http.ResponseWriter, r *http.Request) {
+	assignment := &RoleAssignment{}
+	if err := json.NewDecoder(r.Body).Decode(assignment); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "could not parse role assignment: "+err.Error())
+		return
+	}
+	assignment.ID = mux.Vars(r)["assignmentId"]
+
+	if assignment.PrincipalID == "" || assignment.Scope == "" {
+		writeAdminError(w, http.StatusBadRequest, "principal_id and scope are required")
+		return
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	role := FindRoleDefinition(assignment.RoleDefinitionID)
+	if role == nil {
+		writeAdminError(w, http.StatusBadRequest, "role definition not found: "+assignment.RoleDefinitionID)
+		return
+	}
+
+	assignable := false
+	for _, scope := range role.AssignableScopes {
+		assignable = assignable || scope == "/" || scopeCovers(scope, assignment.Scope)
+	}
+	if !assignable {
+		writeAdminError(w, http.StatusBadRequest, "role definition "+role.RoleName+" is not available for assignment at scope "+assignment.Scope)
+		return
+	}
+
+	replaced := false
+	for i, existing := range Config.RoleAssignments {
+		if existing.ID == assignment.ID {
+			Config.RoleAssignments[i] = assignment
+			replaced = true
+		}
+	}
+	if !replaced {
+		Config.RoleAssignments = append(Config.RoleAssignments, assignment)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(assignment)
+}
+
+func AdminRoleAssignmentDelete(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["assignmentId"]
+
+	configLock.Lock()
+	kept := Config.RoleAssignments[:0]
+	for _, existing := range Config.RoleAssignments {
+		if existing.ID != id {
+			kept = append(kept, existing)
+		}
+	}
+	found := len(kept) != len(Config.RoleAssignments)
+	Config.RoleAssignments = kept
+	configLock.Unlock()
+
+	if !found {
+		writeAdminError(w, http.StatusNotFound, "role assignment not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func AdminRoleDefinitionsGet(w http.ResponseWriter, r *http.Request) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"value": append(BuiltInRoles, Config.RoleDefinitions...),
+	})
+}
+
+// AdminRoleDefinitionPut creates or replaces a custom role definition
+func AdminRoleDefinitionPut(w http.ResponseWriter, r *http.Request) {
+	role := &RoleDefinition{}
+	if err := json.NewDecoder(r.Body).Decode(role); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "could not parse role definition: "+err.Error())
+		return
+	}
+	role.ID = mux.Vars(r)["roleDefinitionId"]
+	role.Type = "CustomRole"
+
+	if role.RoleName == "" || len(role.AssignableScopes) == 0 {
+		writeAdminError(w, http.StatusBadRequest, "roleName and assignableScopes are required")
+		return
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	for _, builtIn := range BuiltInRoles {
+		if strings.EqualFold(builtIn.ID, role.ID) || strings.EqualFold(builtIn.RoleName, role.RoleName) {
+			writeAdminError(w, http.StatusConflict, "built-in role "+builtIn.RoleName+" cannot be replaced")
+			return
+		}
+	}
+
+	replaced := false
+	for i, existing := range Config.RoleDefinitions {
+		if strings.EqualFold(existing.ID, role.ID) {
+			Config.RoleDefinitions[i] = role
+			replaced = true
+		}
+	}
+	if !replaced {
+		Config.RoleDefinitions = append(Config.RoleDefinitions, role)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(role)
+}
+
+// AdminRoleDefinitionDelete refuses, like Azure, to delete a role that is still assigned
+func AdminRoleDefinitionDelete(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["roleDefinitionId"]
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	role := FindRoleDefinition(id)
+	if role == nil || role.Type != "CustomRole" {
+		writeAdminError(w, http.StatusNotFound, "custom role definition not found")
+		return
+	}
+
+	for _, assignment := range Config.RoleAssignments {
+		if FindRoleDefinition(assignment.RoleDefinitionID) == role {
+			writeAdminError(w, http.StatusConflict, "RoleDefinitionHasAssignments: role assignment "+assignment.ID+" still uses this role")
+			return
+		}
+	}
+
+	kept := Config.RoleDefinitions[:0]
+	for _, existing := range Config.RoleDefinitions {
+		if existing != role {
+			kept = append(kept, existing)
+		}
+	}
+	Config.RoleDefinitions = kept
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminCheckAccess evaluates one action for a principal at a scope, for both planes
+func AdminCheckAccess(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		PrincipalID string `json:"principal_id"`
+		Scope       string `json:"scope"`
+		Action      string `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "could not parse access check: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{
+		"action_allowed":      CheckAccess(body.PrincipalID, body.Scope, body.Action, false),
+		"data_action_allowed": CheckAccess(body.PrincipalID, body.Scope, body.Action, true),
+	})
+}
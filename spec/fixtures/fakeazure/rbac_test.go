@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeClientObjectID is the principal fake_client's tokens carry
+const fakeClientObjectID = "5e6f7a8b-0000-4000-8000-000000000001"
+
+// vaultRequest calls jack-vault with a fresh Key Vault token of fake_client
+func vaultRequest(method string, path string) *httptest.ResponseRecorder {
+	token, _ := IssueAppToken(DefaultCloud(), "fake_tenant", "fake_client", "https://vault.azure.net", "1.0", Now().Unix(), 3600)
+
+	return serve(method, "/keyvault/jack-vault"+path+"?api-version=7.4", "", map[string]string{"Authorization": "Bearer " + token})
+}
+
+// checkAccess asks the admin API whether fake_client may perform the data action at the scope
+func checkAccess(t *testing.T, scope string, action string) bool {
+	t.Helper()
+
+	recorder := serve(http.MethodPost, "/admin/checkAccess", `{"principal_id": "`+fakeClientObjectID+`", "scope": "`+scope+`", "action": "`+action+`"}`, nil)
+	expectStatus(t, recorder, http.StatusOK)
+
+	return decodeBody(t, recorder)["data_action_allowed"] == true
+}
+
+func TestKeyVaultRbacScopes(t *testing.T) {
+	withDefaultConfig(t)
+
+	vaultID := FindVault("jack-vault").ResourceID()
+	Config.RoleAssignments = []*RoleAssignment{
+		{ID: "one-secret", PrincipalID: fakeClientObjectID, RoleDefinitionID: "Key Vault Secrets User", Scope: vaultID + "/secrets/allowed"},
+	}
+
+	expectStatus(t, vaultRequest(http.MethodGet, "/secrets/allowed"), http.StatusOK)
+
+	// the assignment neither reaches other secrets nor grants more than its role
+	for _, denied := range []struct{ method, path, action string }{
+		{http.MethodGet, "/secrets/other", SecretGetAction},
+		{http.MethodDelete, "/secrets/allowed", SecretDeleteAction},
+	} {
+		recorder := vaultRequest(denied.method, denied.path)
+		expectStatus(t, recorder, http.StatusForbidden)
+
+		body := decodeBody(t, recorder)
+		keyVaultError, _ := body["error"].(map[string]interface{})
+		innerError, _ := keyVaultError["innererror"].(map[string]interface{})
+		message, _ := keyVaultError["message"].(string)
+		if innerError["code"] != "ForbiddenByRbac" || !strings.Contains(message, "oid="+fakeClientObjectID) || !strings.Contains(message, "Action: '"+denied.action+"'") {
+			t.Fatalf("%s %s was not refused as ForbiddenByRbac for the caller and action: %v", denied.method, denied.path, body)
+		}
+	}
+
+	// an assignment on the vault covers every secret in it
+	recorder := serve(http.MethodPut, "/admin/roleAssignments/whole-vault", `{"principal_id": "`+fakeClientObjectID+`", "role_definition_id": "Key Vault Secrets Officer", "scope": "`+vaultID+`"}`, nil)
+	expectStatus(t, recorder, http.StatusOK)
+
+	expectStatus(t, vaultRequest(http.MethodGet, "/secrets/other"), http.StatusOK)
+	expectStatus(t, vaultRequest(http.MethodDelete, "/secrets/allowed"), http.StatusOK)
+	expectStatus(t, vaultRequest(http.MethodGet, "/keys/some-key"), http.StatusForbidden)
+}
+
+func TestCustomRoleInheritedFromManagementGroup(t *testing.T) {
+	withDefaultConfig(t)
+
+	vaultID := FindVault("jack-vault").ResourceID()
+	otherVaultID := "/subscriptions/11111111-0000-4000-8000-000000000001/resourceGroups/elsewhere/providers/Microsoft.KeyVault/vaults/other-vault"
+
+	Config.RoleAssignments = nil
+	Config.ManagementGroups = []*ManagementGroup{
+		{Name: "platform"},
+		{Name: "workloads", Parent: "platform", Subscriptions: []string{defaultSubscriptionID}},
+		{Name: "sandbox", Subscriptions: []string{"11111111-0000-4000-8000-000000000001"}},
+	}
+
+	recorder := serve(http.MethodPut, "/admin/roleDefinitions/secrets-no-delete", `{
+		"roleName": "Secrets without delete",
+		"assignableScopes": ["/providers/Microsoft.Management/managementGroups/platform"],
+		"dataActions": ["Microsoft.KeyVault/vaults/secrets/*"],
+		"notDataActions": ["Microsoft.KeyVault/vaults/secrets/delete"]
+	}`, nil)
+	expectStatus(t, recorder, http.StatusOK)
+
+	recorder = serve(http.MethodPut, "/admin/roleAssignments/from-platform", `{"principal_id": "`+fakeClientObjectID+`", "role_definition_id": "secrets-no-delete", "scope": "/providers/Microsoft.Management/managementGroups/platform"}`, nil)
+	expectStatus(t, recorder, http.StatusOK)
+
+	// the subscription sits in a child group of platform, so the vault inherits the assignment
+	if !checkAccess(t, vaultID+"/secrets/s", SecretGetAction) {
+		t.Fatal("assignment on a parent management group was not inherited")
+	}
+	if checkAccess(t, vaultID+"/secrets/s", SecretDeleteAction) {
+		t.Fatal("notDataActions did not take delete away")
+	}
+	if checkAccess(t, vaultID+"/keys/k", KeyReadAction) {
+		t.Fatal("custom role granted a data action outside its dataActions")
+	}
+	if checkAccess(t, otherVaultID+"/secrets/s", SecretGetAction) {
+		t.Fatal("assignment reached a subscription outside the management group")
+	}
+
+	expectStatus(t, vaultRequest(http.MethodGet, "/secrets/s"), http.StatusOK)
+	expectStatus(t, vaultRequest(http.MethodDelete, "/secrets/s"), http.StatusForbidden)
+
+	// the role cannot go while it is assigned, nor be assigned outside its assignable scopes
+	expectStatus(t, serve(http.MethodDelete, "/admin/roleDefinitions/secrets-no-delete", "", nil), http.StatusConflict)
+
+	recorder = serve(http.MethodPut, "/admin/roleAssignments/in-sandbox", `{"principal_id": "`+fakeClientObjectID+`", "role_definition_id": "secrets-no-delete", "scope": "`+otherVaultID+`"}`, nil)
+	expectStatus(t, recorder, http.StatusBadRequest)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type RevokeTokensRequest struct {
+	Token       string `json:"token"`
+	PrincipalID string `json:"principal_id"`
+}
+
+// ClaimsChallenge is the base64 `claims` a CAE-capable client sends back to the token endpoint,
+// asking for a token issued after the revocation
+func ClaimsChallenge(revokedAt int64) string {
+	challenge, _ := json.Marshal(map[string]interface{}{
+		"access_token": map[string]interface{}{
+			"nbf": map[string]interface{}{
+				"essential": true,
+				"value":     strconv.FormatInt(revokedAt, 10),
+			},
+		},
+	})
+
+	return base64.StdEncoding.EncodeToString(challenge)
+}
+
+// writeKeyVaultTokenRevoked answers a revoked token with the claims challenge of continuous access evaluation
+func writeKeyVaultTokenRevoked(w http.ResponseWriter, r *http.Request, vaultName string, revokedAt int64) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer authorization="%s/%s", resource="%s", error="insufficient_claims", claims="%s"`,
+		authorityHost(r), FindVault(vaultName).TenantFor(), CloudFor(r).KeyVaultAudience, ClaimsChallenge(revokedAt)))
+	KeyVaultUnauthorized.Write(w, "Continuous access evaluation resulted in challenge with result: InteractionRequired and code: TokenCreatedWithOutdatedPolicies")
+}
+
+// validateClaimsParameter checks the optional `claims` of a token request, which must be a JSON object
+func validateClaimsParameter(w http.ResponseWriter, claims string) bool {
+	if claims == "" {
+		return true
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(claims), &parsed); err != nil {
+		AADInvalidClaims.Write(w)
+		return false
+	}
+
+	return true
+}
+
+// AdminRevokeTokens revokes a single token, or every token held by a principal
+func AdminRevokeTokens(w http.ResponseWriter, r *http.Request) {
+	var request RevokeTokensRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "could not parse the revocation: "+err.Error())
+		return
+	}
+
+	now := Now().Unix()
+	revoked := 0
+
+	switch {
+	case request.Token != "" && request.PrincipalID != "":
+		writeAdminError(w, http.StatusBadRequest, "only one of token or principal_id may be given")
+		return
+
+	case request.Token != "":
+		if !Tokens.Revoke(request.Token, now) {
+			writeAdminError(w, http.StatusBadRequest, "token was not issued by fakeazure")
+			return
+		}
+		revoked = 1
+
+	case request.PrincipalID != "":
+		revoked = Tokens.RevokePrincipal(request.PrincipalID, now)
+
+	default:
+		writeAdminError(w, http.StatusBadRequest, "token or principal_id is required")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revoked": revoked,
+		"claims":  ClaimsChallenge(now),
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+var challengeClaims = regexp.MustCompile(`error="insufficient_claims", claims="([^"]+)"`)
+
+// getSecretWith reads a secret of jack-vault with the given token
+func getSecretWith(token string) *httptest.ResponseRecorder {
+	return serve(http.MethodGet, "/keyvault/jack-vault/secrets/demo?api-version=7.4", "", map[string]string{"Authorization": "Bearer " + token})
+}
+
+func TestRevokedTokenGetsClaimsChallenge(t *testing.T) {
+	withDefaultConfig(t)
+
+	token, _ := IssueAppToken(DefaultCloud(), "fake_tenant", "fake_client", "https://vault.azure.net", "1.0", Now().Unix(), 3600)
+	expectStatus(t, getSecretWith(token), http.StatusOK)
+
+	recorder := serve(http.MethodPost, "/admin/tokens/revoke", `{"token": "`+token+`"}`, nil)
+	expectStatus(t, recorder, http.StatusOK)
+	if revoked := decodeBody(t, recorder)["revoked"]; revoked != float64(1) {
+		t.Fatalf("revoked %v tokens, want 1", revoked)
+	}
+
+	recorder = getSecretWith(token)
+	expectStatus(t, recorder, http.StatusUnauthorized)
+
+	match := challengeClaims.FindStringSubmatch(recorder.Header().Get("WWW-Authenticate"))
+	if match == nil {
+		t.Fatalf("revoked token got no claims challenge: %q", recorder.Header().Get("WWW-Authenticate"))
+	}
+
+	claims, err := base64.StdEncoding.DecodeString(match[1])
+	if err != nil {
+		t.Fatalf("claims challenge is not base64: %s", err)
+	}
+
+	var challenge struct {
+		AccessToken struct {
+			Nbf struct {
+				Essential bool   `json:"essential"`
+				Value     string `json:"value"`
+			} `json:"nbf"`
+		} `json:"access_token"`
+	}
+	if err := json.Unmarshal(claims, &challenge); err != nil || !challenge.AccessToken.Nbf.Essential {
+		t.Fatalf("claims challenge does not ask for an essential nbf: %s", claims)
+	}
+
+	issued, _ := Tokens.Lookup("Bearer " + token)
+	if challenge.AccessToken.Nbf.Value != strconv.FormatInt(issued.RevokedAt, 10) {
+		t.Fatalf("challenge asks for nbf %s, want the revocation time %d", challenge.AccessToken.Nbf.Value, issued.RevokedAt)
+	}
+
+	// the client answers the challenge with a fresh token, which is accepted
+	recorder = postForm("/fake_tenant/oauth2/v2.0/token", url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {"fake_client"},
+		"client_secret": {"fake_secret"},
+		"scope":         {"https://vault.azure.net/.default"},
+		"claims":        {string(claims)},
+	})
+	expectStatus(t, recorder, http.StatusOK)
+	expectStatus(t, getSecretWith(decodeBody(t, recorder)["access_token"].(string)), http.StatusOK)
+}
+
+func TestAdminRevokeTokens(t *testing.T) {
+	withDefaultConfig(t)
+
+	var tokens []string
+	for i := 0; i < 2; i++ {
+		token, _ := IssueAppToken(DefaultCloud(), "fake_tenant", "revoked_client", "https://vault.azure.net", "1.0", Now().Unix(), 3600)
+		tokens = append(tokens, token)
+	}
+
+	recorder := serve(http.MethodPost, "/admin/tokens/revoke", `{"principal_id": "`+PrincipalIDFor("revoked_client")+`"}`, nil)
+	expectStatus(t, recorder, http.StatusOK)
+	if revoked := decodeBody(t, recorder)["revoked"]; revoked != float64(2) {
+		t.Fatalf("revoked %v tokens of the principal, want 2", revoked)
+	}
+
+	for _, token := range tokens {
+		expectStatus(t, getSecretWith(token), http.StatusUnauthorized)
+	}
+
+	for _, body := range []string{
+		`{"token": "not-a-fakeazure-token"}`,
+		`{"token": "` + tokens[0] + `", "principal_id": "someone"}`,
+		`{}`,
+	} {
+		expectStatus(t, serve(http.MethodPost, "/admin/tokens/revoke", body, nil), http.StatusBadRequest)
+	}
+
+	// a claims parameter that is not JSON is refused by the token endpoint
+	recorder = postForm("/fake_tenant/oauth2/v2.0/token", url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {"fake_client"},
+		"client_secret": {"fake_secret"},
+		"scope":         {"https://vault.azure.net/.default"},
+		"claims":        {"not json"},
+	})
+	expectStatus(t, recorder, http.StatusBadRequest)
+	expectAADError(t, recorder, 90014)
+}
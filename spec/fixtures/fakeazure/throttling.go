@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// throttlingWindow is the period, in seconds, that service limits are counted over, as in Azure
+const throttlingWindow = 10
+
+// ThrottlingConfig sets how many transactions are allowed per 10 seconds. 0 means no limit.
+type ThrottlingConfig struct {
+	// per vault, by the collection the operation is on
+	KeyVault KeyVaultLimits `json:"key_vault"`
+	// per tenant and client ID, on the token endpoints
+	TokenRequests int `json:"token_requests"`
+}
+
+type KeyVaultLimits struct {
+	Secrets      int `json:"secrets"`
+	Keys         int `json:"keys"`
+	Certificates int `json:"certificates"`
+}
+
+func (l KeyVaultLimits) For(collection string) int {
+	switch collection {
+	case "secrets":
+		return l.Secrets
+	case "keys":
+		return l.Keys
+	case "certificates":
+		return l.Certificates
+	}
+
+	return 0
+}
+
+type throttlingCounter struct {
+	windowStart int64
+	count       int
+}
+
+var throttlingCounters = map[string]*throttlingCounter{}
+var throttlingLock sync.Mutex
+
+// takeTransaction counts a transaction against a limit. When the limit has been reached it
+// returns false and the seconds left until the window resets.
+func takeTransaction(key string, limit int) (bool, int64) {
+	if limit <= 0 {
+		return true, 0
+	}
+
+	now := Now().Unix()
+	windowStart := now - now%throttlingWindow
+
+	throttlingLock.Lock()
+	defer throttlingLock.Unlock()
+
+	counter, ok := throttlingCounters[key]
+	if !ok || counter.windowStart != windowStart {
+		counter = &throttlingCounter{windowStart: windowStart}
+		throttlingCounters[key] = counter
+	}
+
+	if counter.count >= limit {
+		return false, windowStart + throttlingWindow - now
+	}
+	counter.count++
+
+	return true, 0
+}
+
+// ThrottleKeyVault enforces the per-vault limits ahead of the Key Vault handlers
+func ThrottleKeyVault(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vaultName := mux.Vars(r)["vaultName"]
+		collection := keyVaultCollection(r)
+
+		configLock.Lock()
+		limit := Config.Throttling.KeyVault.For(collection)
+		configLock.Unlock()
+
+		allowed, retryAfter := takeTransaction("vault/"+strings.ToLower(vaultName)+"/"+collection, limit)
+		if allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		KeyVaultThrottled.Write(w, vaultName)
+	})
+}
+
+func keyVaultCollection(r *http.Request) string {
+	vars := mux.Vars(r)
+	switch {
+	case vars["secretName"] != "":
+		return "secrets"
+	case vars["keyName"] != "":
+		return "keys"
+	case vars["certificateName"] != "":
+		return "certificates"
+	}
+
+	return ""
+}
+
+// allowTokenRequest enforces the token endpoint limit, writing AAD's 429 when it is reached
+func allowTokenRequest(w http.ResponseWriter, tenantID string, clientID string) bool {
+	configLock.Lock()
+	limit := Config.Throttling.TokenRequests
+	configLock.Unlock()
+
+	allowed, retryAfter := takeTransaction("token/"+strings.ToLower(tenantID)+"/"+clientID, limit)
+	if allowed {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	AADRequestLoop.Write(w)
+
+	return false
+}
+
+func AdminThrottlingGet(w http.ResponseWriter, r *http.Request) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Config.Throttling)
+}
+
+// AdminThrottlingPut replaces the limits and starts counting afresh
+func AdminThrottlingPut(w http.ResponseWriter, r *http.Request) {
+	var throttling ThrottlingConfig
+	if err := json.NewDecoder(r.Body).Decode(&throttling); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "could not parse throttling limits: "+err.Error())
+		return
+	}
+
+	configLock.Lock()
+	Config.Throttling = throttling
+	configLock.Unlock()
+
+	throttlingLock.Lock()
+	throttlingCounters = map[string]*throttlingCounter{}
+	throttlingLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(throttling)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IssuedToken is what fakeazure remembers about an access token it has handed out
+type IssuedToken struct {
+	ID          string `json:"uti"`
+	PrincipalID string `json:"principal_id"`
+	ClientID    string `json:"client_id"`
+	TenantID    string `json:"tenant_id"`
+	Audience    string `json:"audience"`
+	Scope       string `json:"scope,omitempty"`
+	IssuedAt    int64  `json:"issued_at"`
+	ExpiresAt   int64  `json:"expires_at"`
+	RevokedAt   int64  `json:"revoked_at,omitempty"`
+}
+
+// TokenStore holds every access token that Key Vault accepts, keyed by the raw token.
+// It is shared by all handlers, so every access goes through its lock.
+type TokenStore struct {
+	lock   sync.RWMutex
+	tokens map[string]*IssuedToken
+}
+
+var Tokens = NewTokenStore()
+
+func NewTokenStore() *TokenStore {
+	return &TokenStore{
+		tokens: map[string]*IssuedToken{},
+	}
+}
+
+// IssueToken mints a token and stores it as authorised until its `exp`
+func IssueToken(claims Claims) string {
+	token := MintToken(claims)
+	Tokens.Add(token, claims)
+
+	return token
+}
+
+func (s *TokenStore) Add(token string, claims Claims) {
+	issued := &IssuedToken{
+		ID:          claims.String("uti"),
+		PrincipalID: claims.String("oid"),
+		ClientID:    claims.String("appid"),
+		TenantID:    claims.String("tid"),
+		Audience:    claims.String("aud"),
+		Scope:       claims.String("scp"),
+		IssuedAt:    claims.Int64("iat"),
+		ExpiresAt:   claims.Int64("exp"),
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.tokens[token] = issued
+}
+
+// Lookup finds the token presented in an `Authorization: Bearer` header.
+// It returns a copy, so the caller can read it without holding the lock.
+func (s *TokenStore) Lookup(authHeader string) (IssuedToken, bool) {
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return IssuedToken{}, false
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	issued, ok := s.tokens[strings.TrimPrefix(authHeader, "Bearer ")]
+	if !ok {
+		return IssuedToken{}, false
+	}
+
+	return *issued, true
+}
+
+func (t IssuedToken) Revoked() bool {
+	return t.RevokedAt != 0
+}
+
+// Revoke marks a single token as revoked, returning false if it is not (or no longer) stored
+func (s *TokenStore) Revoke(token string, now int64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	issued, ok := s.tokens[strings.TrimPrefix(token, "Bearer ")]
+	if !ok {
+		return false
+	}
+
+	if !issued.Revoked() {
+		issued.RevokedAt = now
+	}
+
+	return true
+}
+
+// RevokePrincipal marks every token held by a principal as revoked, and returns how many were
+func (s *TokenStore) RevokePrincipal(principalID string, now int64) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	revoked := 0
+	for _, issued := range s.tokens {
+		if issued.PrincipalID == principalID && !issued.Revoked() {
+			issued.RevokedAt = now
+			revoked++
+		}
+	}
+
+	return revoked
+}
+
+// List returns the metadata of every stored token
+func (s *TokenStore) List() []IssuedToken {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	list := make([]IssuedToken, 0, len(s.tokens))
+	for _, issued := range s.tokens {
+		list = append(list, *issued)
+	}
+
+	return list
+}
+
+// Sweep forgets tokens that expired before the cutoff, and returns how many were removed
+func (s *TokenStore) Sweep(cutoff int64) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	swept := 0
+	for token, issued := range s.tokens {
+		if issued.ExpiresAt < cutoff {
+			delete(s.tokens, token)
+			swept++
+		}
+	}
+
+	return swept
+}
+
+// StartSweeper removes expired tokens, authorization codes and refresh tokens in the background. They are kept for `retention` seconds
+// after expiry, so that Key Vault can still tell an expired token from an unknown one.
+// An interval of 0 turns sweeping off.
+func (s *TokenStore) StartSweeper(interval time.Duration, retention int64) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			cutoff := Now().Unix() - retention
+			if swept := s.Sweep(cutoff); swept > 0 {
+				log.Printf("Swept %d expired tokens\n", swept)
+			}
+
+			if swept := SweepDelegatedGrants(cutoff); swept > 0 {
+				log.Printf("Swept %d expired authorization codes and refresh tokens\n", swept)
+			}
+		}
+	}()
+}
+
+// AdminTokensGet lists the metadata of the stored tokens, without the tokens themselves
+func AdminTokensGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"value": Tokens.List(),
+	})
+}
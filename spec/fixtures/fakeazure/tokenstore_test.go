@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestTokenStoreConcurrentAccess issues, looks up, revokes and sweeps tokens from many goroutines
+// at once. Run it with -race.
+func TestTokenStoreConcurrentAccess(t *testing.T) {
+	store := NewTokenStore()
+	now := Now().Unix()
+
+	const goroutines = 64
+	const tokensEach = 50
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			principal := fmt.Sprintf("principal-%d", g%8)
+			for i := 0; i < tokensEach; i++ {
+				token := fmt.Sprintf("token-%d-%d", g, i)
+				store.Add(token, Claims{
+					"oid": principal,
+					"exp": now + 3600,
+					"iat": now,
+				})
+
+				issued, ok := store.Lookup("Bearer " + token)
+				if !ok {
+					t.Errorf("token %s was not found right after it was added", token)
+					return
+				}
+				if issued.PrincipalID != principal {
+					t.Errorf("token %s belongs to %s, want %s", token, issued.PrincipalID, principal)
+				}
+
+				if i%10 == 0 {
+					store.RevokePrincipal(principal, now)
+					store.List()
+					store.Sweep(now)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if got := len(store.List()); got != goroutines*tokensEach {
+		t.Fatalf("store holds %d tokens, want %d", got, goroutines*tokensEach)
+	}
+
+	if swept := store.Sweep(now + 3601); swept != goroutines*tokensEach {
+		t.Fatalf("swept %d tokens, want %d", swept, goroutines*tokensEach)
+	}
+}
+
+// BenchmarkTokenStore mixes the calls Key Vault traffic makes: mostly lookups, with issuing and
+// the occasional sweep
+func BenchmarkTokenStore(b *testing.B) {
+	store := NewTokenStore()
+	now := Now().Unix()
+
+	const preloaded = 10000
+	for i := 0; i < preloaded; i++ {
+		store.Add(fmt.Sprintf("preloaded-%d", i), Claims{"exp": now + 3600})
+	}
+
+	var counter int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddInt64(&counter, 1)
+
+			switch {
+			case n%1000 == 0:
+				store.Sweep(now)
+			case n%10 == 0:
+				store.Add(fmt.Sprintf("issued-%d", n), Claims{"exp": now + 3600})
+			default:
+				if _, ok := store.Lookup(fmt.Sprintf("Bearer preloaded-%d", n%preloaded)); !ok {
+					b.Fatal("preloaded token was not found")
+				}
+			}
+		}
+	})
+}
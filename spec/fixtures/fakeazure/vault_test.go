@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestAdminVaultPatchConcurrentWithReads patches a vault's access policies while other goroutines
+// check them. Run it with -race.
+func TestAdminVaultPatchConcurrentWithReads(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/vaults/{vaultName}", AdminVaultPatch).Methods("PATCH")
+
+	bodies := []string{
+		`{"enableRbacAuthorization": false, "accessPolicies": [{"tenantId": "t", "objectId": "o", "permissions": {"secrets": ["get"]}}]}`,
+		`{"enableRbacAuthorization": true, "accessPolicies": [{"tenantId": "t", "objectId": "o", "permissions": {"secrets": ["list", "set"]}}]}`,
+	}
+
+	done := make(chan struct{})
+
+	var readers sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		readers.Add(1)
+
+		go func() {
+			defer readers.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				vault := FindVault("race-vault")
+				vault.RbacEnabled()
+				CheckAccessPolicy(vault, "t", "o", "secrets", "get")
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				request := httptest.NewRequest("PATCH", "/admin/vaults/race-vault", strings.NewReader(bodies[(g+i)%2]))
+				recorder := httptest.NewRecorder()
+				r.ServeHTTP(recorder, request)
+
+				if recorder.Code != http.StatusOK {
+					t.Errorf("patch answered %d: %s", recorder.Code, recorder.Body.String())
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	vault := FindVault("race-vault")
+	if len(vault.AccessPolicies) != 1 {
+		t.Fatalf("vault holds %d access policies, want 1", len(vault.AccessPolicies))
+	}
+}
+
+// TestFindVaultReturnsCopy checks that changing the vault FindVault returns leaves the configured one alone
+func TestFindVaultReturnsCopy(t *testing.T) {
+	ReplaceVault(&Vault{
+		Name:           "copy-vault",
+		AccessPolicies: []*AccessPolicy{{TenantID: "t", ObjectID: "o", Permissions: AccessPolicyPermissions{Secrets: []string{"get"}}}},
+	})
+
+	vault := FindVault("copy-vault")
+	vault.AccessPolicies[0].Permissions.Secrets[0] = "purge"
+	vault.Location = "westus"
+
+	again := FindVault("copy-vault")
+	if again.AccessPolicies[0].Permissions.Secrets[0] != "get" || again.Location != "eastus" {
+		t.Fatalf("configured vault was changed through a copy: %+v", again)
+	}
+}
+
+// TestAdminVaultPatchReplacesAccessPolicies checks that a patched list replaces the old one,
+// rather than being merged into it entry by entry
+func TestAdminVaultPatchReplacesAccessPolicies(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/vaults/{vaultName}", AdminVaultPatch).Methods("PATCH")
+
+	patch := func(body string) {
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, httptest.NewRequest("PATCH", "/admin/vaults/replace-vault", strings.NewReader(body)))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("patch answered %d: %s", recorder.Code, recorder.Body.String())
+		}
+	}
+
+	patch(`{"enableRbacAuthorization": false, "accessPolicies": [{"tenantId": "tenant-a", "objectId": "principal-a", "permissions": {"keys": ["all"], "secrets": ["get", "list"]}}]}`)
+	patch(`{"accessPolicies": [{"tenantId": "tenant-b", "objectId": "principal-b", "permissions": {"certificates": ["get"]}}]}`)
+
+	vault := FindVault("replace-vault")
+	if len(vault.AccessPolicies) != 1 {
+		t.Fatalf("vault holds %d access policies, want 1", len(vault.AccessPolicies))
+	}
+
+	policy := vault.AccessPolicies[0]
+	if policy.ObjectID != "principal-b" || len(policy.Permissions.Keys) != 0 || len(policy.Permissions.Secrets) != 0 {
+		t.Fatalf("second principal inherited permissions of the first: %+v", policy.Permissions)
+	}
+	if CheckAccessPolicy(vault, "tenant-a", "principal-a", "secrets", "get") || CheckAccessPolicy(vault, "tenant-b", "principal-b", "keys", "get") {
+		t.Fatal("replaced access policies still grant access")
+	}
+	if !CheckAccessPolicy(vault, "tenant-b", "principal-b", "certificates", "get") {
+		t.Fatal("new access policy does not grant its own permissions")
+	}
+
+	// a patch without the list keeps it
+	patch(`{"location": "westeurope"}`)
+	if vault := FindVault("replace-vault"); len(vault.AccessPolicies) != 1 || vault.AccessPolicies[0].ObjectID != "principal-b" {
+		t.Fatalf("patch without accessPolicies changed them: %+v", vault.AccessPolicies)
+	}
+}